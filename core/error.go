@@ -26,6 +26,7 @@ const (
 	ErrorCodeBadGateway                  ErrorCode = "BAD_GATEWAY"
 	ErrorCodeBadRequest                  ErrorCode = "BAD_REQUEST"
 	ErrorCodeConflict                    ErrorCode = "CONFLICT"
+	ErrorCodeContentTooLarge             ErrorCode = "CONTENT_TOO_LARGE"
 	ErrorCodeForbidden                   ErrorCode = "FORBIDDEN"
 	ErrorCodeGone                        ErrorCode = "GONE"
 	ErrorCodeInternalServerError         ErrorCode = "INTERNAL_SERVER_ERROR"
@@ -147,6 +148,7 @@ var errorCodeByStatusCode = map[int]ErrorCode{
 	http.StatusBadGateway:                 ErrorCodeBadGateway,
 	http.StatusBadRequest:                 ErrorCodeBadRequest,
 	http.StatusConflict:                   ErrorCodeConflict,
+	http.StatusRequestEntityTooLarge:      ErrorCodeContentTooLarge,
 	http.StatusForbidden:                  ErrorCodeForbidden,
 	http.StatusGone:                       ErrorCodeGone,
 	http.StatusInternalServerError:        ErrorCodeInternalServerError,
@@ -167,6 +169,7 @@ var statusCodeByErrorCode = map[ErrorCode]int{
 	ErrorCodeBadGateway:                  http.StatusBadGateway,
 	ErrorCodeBadRequest:                  http.StatusBadRequest,
 	ErrorCodeConflict:                    http.StatusConflict,
+	ErrorCodeContentTooLarge:             http.StatusRequestEntityTooLarge,
 	ErrorCodeForbidden:                   http.StatusForbidden,
 	ErrorCodeGone:                        http.StatusGone,
 	ErrorCodeInternalServerError:         http.StatusInternalServerError,
@@ -0,0 +1,122 @@
+package core
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+)
+
+// Length of the truncated HMAC-SHA256 tag of signed tokens
+const tokenTagSize = 16
+
+var ErrInvalidToken = errors.New("invalid token")
+
+// Keys are bound to the server secret, so tokens can not be forged from the
+// user password alone.
+func deriveTokenKey(purpose, password string) []byte {
+	mac := hmac.New(sha256.New, jwtSecret)
+	mac.Write([]byte(purpose))
+	mac.Write([]byte{0})
+	mac.Write([]byte(password))
+	return mac.Sum(nil)
+}
+
+func newTokenAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func sealToken(key []byte, payload, ad []byte) ([]byte, error) {
+	aead, err := newTokenAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(payload)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, payload, ad), nil
+}
+
+func openToken(key []byte, sealed, ad []byte) ([]byte, error) {
+	aead, err := newTokenAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize()+aead.Overhead() {
+		return nil, ErrInvalidToken
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	payload, err := aead.Open(nil, nonce, ciphertext, ad)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	return payload, nil
+}
+
+// SealToken encrypts payload with AES-256-GCM under a key derived from the
+// server secret and password. ad is authenticated but not encrypted, the
+// nonce is prepended to the output.
+func SealToken(password string, payload, ad []byte) ([]byte, error) {
+	return sealToken(deriveTokenKey("token:seal", password), payload, ad)
+}
+
+// OpenToken reverses SealToken
+func OpenToken(password string, sealed, ad []byte) ([]byte, error) {
+	return openToken(deriveTokenKey("token:seal", password), sealed, ad)
+}
+
+// SealTokenEnvelope is SealToken with a key derived from the server secret
+// only, for payloads that carry the user themselves.
+func SealTokenEnvelope(payload, ad []byte) ([]byte, error) {
+	return sealToken(deriveTokenKey("token:envelope", ""), payload, ad)
+}
+
+// OpenTokenEnvelope reverses SealTokenEnvelope
+func OpenTokenEnvelope(sealed, ad []byte) ([]byte, error) {
+	return openToken(deriveTokenKey("token:envelope", ""), sealed, ad)
+}
+
+// TokenPasswordHash fingerprints password, so a token can be revoked by a
+// password change without embedding the password.
+func TokenPasswordHash(password string) []byte {
+	return deriveTokenKey("token:password", password)[:8]
+}
+
+// TokenSignature returns the truncated HMAC-SHA256 of data, keyed by the server secret
+func TokenSignature(data []byte) []byte {
+	mac := hmac.New(sha256.New, deriveTokenKey("token:sign", ""))
+	mac.Write(data)
+	return mac.Sum(nil)[:tokenTagSize]
+}
+
+// AuditHash returns the HMAC-SHA256 of data, keyed by the server secret, so
+// the audit log chain can not be recomputed without it
+func AuditHash(data []byte) []byte {
+	mac := hmac.New(sha256.New, deriveTokenKey("audit:chain", ""))
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// SignToken appends a truncated HMAC-SHA256 tag of data, keyed by the server secret
+func SignToken(data []byte) []byte {
+	return append(data, TokenSignature(data)...)
+}
+
+// VerifyToken checks the tag appended by SignToken and returns the data
+func VerifyToken(signed []byte) ([]byte, error) {
+	if len(signed) < tokenTagSize {
+		return nil, ErrInvalidToken
+	}
+	data, tag := signed[:len(signed)-tokenTagSize], signed[len(signed)-tokenTagSize:]
+	if !hmac.Equal(tag, TokenSignature(data)) {
+		return nil, ErrInvalidToken
+	}
+	return data, nil
+}
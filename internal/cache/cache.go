@@ -1,7 +1,9 @@
 package cache
 
 import (
+	"container/list"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -9,55 +11,127 @@ import (
 type CacheConfig struct {
 	Name     string
 	Lifetime time.Duration
+	// Maximum number of items, the least recently used are evicted past it.
+	// Zero is unbounded.
+	MaxSize int
 }
 
 type cacheItem[T any] struct {
+	key     string
 	value   T
 	expires time.Time
 }
 
-// Cache provides thread-safe generic caching with expiration
+// CacheStats holds the counters of a cache
+type CacheStats struct {
+	Name        string `json:"name"`
+	Size        int    `json:"size"`
+	MaxSize     int    `json:"max_size,omitempty"`
+	Hits        int64  `json:"hits"`
+	Misses      int64  `json:"misses"`
+	Evictions   int64  `json:"evictions"`
+	Expirations int64  `json:"expirations"`
+}
+
+// Cache provides thread-safe generic caching with expiration, bounded in
+// size and evicting the least recently used items
 type Cache[T any] struct {
-	mu       sync.RWMutex
-	items    map[string]cacheItem[T]
+	name     string
+	mu       sync.Mutex
+	items    map[string]*list.Element
+	lru      *list.List
 	lifetime time.Duration
+	maxSize  int
+
+	hits        atomic.Int64
+	misses      atomic.Int64
+	evictions   atomic.Int64
+	expirations atomic.Int64
 }
 
-// NewCache creates new cache instance with given config
-func NewCache[T any](config *CacheConfig) Cache[T] {
-	return Cache[T]{
-		items:    make(map[string]cacheItem[T]),
+// Longest interval between removals of expired items
+const maxSweepInterval = time.Minute
+
+// NewCache creates new cache instance with given config, expired items are
+// removed in the background
+func NewCache[T any](config *CacheConfig) *Cache[T] {
+	c := &Cache[T]{
+		name:     config.Name,
+		items:    make(map[string]*list.Element),
+		lru:      list.New(),
 		lifetime: config.Lifetime,
+		maxSize:  config.MaxSize,
+	}
+	register(c)
+	if c.lifetime > 0 {
+		go func() {
+			for range time.Tick(min(c.lifetime, maxSweepInterval)) {
+				c.sweep(time.Now())
+			}
+		}()
 	}
+	return c
 }
 
-// Get retrieves item from cache, checking expiration
+func (c *Cache[T]) remove(elem *list.Element) {
+	c.lru.Remove(elem)
+	delete(c.items, elem.Value.(*cacheItem[T]).key)
+}
+
+// Get retrieves item from cache, removing it once expired
 func (c *Cache[T]) Get(key string) (T, bool) {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-	item, exists := c.items[key]
+	var zero T
+
+	elem, exists := c.items[key]
 	if !exists {
-		var zero T
+		c.misses.Add(1)
 		return zero, false
 	}
 
-	if time.Now().After(item.expires) {
-		var zero T
+	item := elem.Value.(*cacheItem[T])
+	if !time.Now().Before(item.expires) {
+		c.remove(elem)
+		c.expirations.Add(1)
+		c.misses.Add(1)
 		return zero, false
 	}
 
+	c.lru.MoveToFront(elem)
+	c.hits.Add(1)
 	return item.value, true
 }
 
 // Set stores item in cache with TTL expiration
 func (c *Cache[T]) Set(key string, value T) {
+	c.SetWithExpiry(key, value, time.Time{})
+}
+
+// SetWithExpiry stores item in cache until the TTL or expiresAt, whichever
+// comes first. A zero expiresAt only uses the TTL.
+func (c *Cache[T]) SetWithExpiry(key string, value T, expiresAt time.Time) {
+	expires := time.Now().Add(c.lifetime)
+	if !expiresAt.IsZero() && expiresAt.Before(expires) {
+		expires = expiresAt
+	}
+
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	c.items[key] = cacheItem[T]{
-		value:   value,
-		expires: time.Now().Add(c.lifetime),
+	if elem, exists := c.items[key]; exists {
+		item := elem.Value.(*cacheItem[T])
+		item.value = value
+		item.expires = expires
+		c.lru.MoveToFront(elem)
+		return
+	}
+
+	c.items[key] = c.lru.PushFront(&cacheItem[T]{key: key, value: value, expires: expires})
+	for c.maxSize > 0 && c.lru.Len() > c.maxSize {
+		c.remove(c.lru.Back())
+		c.evictions.Add(1)
 	}
 }
 
@@ -66,5 +140,73 @@ func (c *Cache[T]) Delete(key string) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	delete(c.items, key)
-}
\ No newline at end of file
+	if elem, exists := c.items[key]; exists {
+		c.remove(elem)
+	}
+}
+
+// Len returns the number of items, expired ones included until swept
+func (c *Cache[T]) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.lru.Len()
+}
+
+// sweep removes the items expired at now, returning their count
+func (c *Cache[T]) sweep(now time.Time) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	count := 0
+	for elem := c.lru.Back(); elem != nil; {
+		prev := elem.Prev()
+		if !now.Before(elem.Value.(*cacheItem[T]).expires) {
+			c.remove(elem)
+			count++
+		}
+		elem = prev
+	}
+	c.expirations.Add(int64(count))
+	return count
+}
+
+func (c *Cache[T]) Stats() CacheStats {
+	return CacheStats{
+		Name:        c.name,
+		Size:        c.Len(),
+		MaxSize:     c.maxSize,
+		Hits:        c.hits.Load(),
+		Misses:      c.misses.Load(),
+		Evictions:   c.evictions.Load(),
+		Expirations: c.expirations.Load(),
+	}
+}
+
+type statsProvider interface {
+	Stats() CacheStats
+}
+
+var registry struct {
+	mu     sync.Mutex
+	caches []statsProvider
+}
+
+func register(c statsProvider) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+
+	registry.caches = append(registry.caches, c)
+}
+
+// AllStats returns the stats of every cache, in creation order
+func AllStats() []CacheStats {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+
+	stats := make([]CacheStats, len(registry.caches))
+	for i, c := range registry.caches {
+		stats[i] = c.Stats()
+	}
+	return stats
+}
@@ -0,0 +1,66 @@
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type CacheTestSuite struct {
+	suite.Suite
+}
+
+func (s *CacheTestSuite) TestEviction() {
+	c := NewCache[int](&CacheConfig{Name: "test:eviction", Lifetime: time.Hour, MaxSize: 2})
+	c.Set("a", 1)
+	c.Set("b", 2)
+	_, ok := c.Get("a")
+	s.True(ok)
+	c.Set("c", 3)
+
+	_, ok = c.Get("b")
+	s.False(ok, "least recently used is evicted")
+	v, ok := c.Get("a")
+	s.True(ok)
+	s.Equal(1, v)
+	s.Equal(2, c.Len())
+
+	stats := c.Stats()
+	s.Equal(int64(2), stats.Hits)
+	s.Equal(int64(1), stats.Misses)
+	s.Equal(int64(1), stats.Evictions)
+	s.Equal(2, stats.Size)
+}
+
+func (s *CacheTestSuite) TestExpiry() {
+	c := NewCache[int](&CacheConfig{Name: "test:expiry", Lifetime: time.Hour})
+	c.SetWithExpiry("past", 1, time.Now().Add(-time.Second))
+	c.SetWithExpiry("soon", 2, time.Now().Add(time.Minute))
+	c.SetWithExpiry("later", 3, time.Now().Add(2*time.Hour))
+
+	_, ok := c.Get("past")
+	s.False(ok)
+	s.Equal(2, c.Len(), "expired item is removed on get")
+
+	s.Equal(1, c.sweep(time.Now().Add(30*time.Minute)))
+	_, ok = c.Get("later")
+	s.True(ok)
+
+	s.Equal(1, c.sweep(time.Now().Add(90*time.Minute)), "expiry is capped at the lifetime")
+	s.Equal(0, c.Len())
+	s.Equal(int64(3), c.Stats().Expirations)
+}
+
+func (s *CacheTestSuite) TestAllStats() {
+	NewCache[int](&CacheConfig{Name: "test:registry", Lifetime: time.Hour})
+	names := []string{}
+	for _, stats := range AllStats() {
+		names = append(names, stats.Name)
+	}
+	s.Contains(names, "test:registry")
+}
+
+func TestCache(t *testing.T) {
+	suite.Run(t, new(CacheTestSuite))
+}
@@ -0,0 +1,112 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+)
+
+func parseBaseURL(value string) (*url.URL, error) {
+	u, err := url.Parse(strings.TrimSpace(value))
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, errors.New("unsupported scheme: " + u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, errors.New("missing host")
+	}
+	if u.RawQuery != "" || u.Fragment != "" {
+		return nil, errors.New("query and fragment not allowed")
+	}
+	return &url.URL{Scheme: u.Scheme, Host: u.Host, Path: strings.TrimRight(u.Path, "/")}, nil
+}
+
+// BaseURLMap holds the public base url by request host, "*" being the default.
+type BaseURLMap map[string]*url.URL
+
+// Get returns a copy of the base url configured for host, matched with and
+// then without its port, or of the default one.
+func (bum BaseURLMap) Get(host string) *url.URL {
+	host = strings.ToLower(host)
+	u, ok := bum[host]
+	if !ok {
+		if hostname, _, err := net.SplitHostPort(host); err == nil {
+			u, ok = bum[hostname]
+		}
+	}
+	if !ok {
+		u = bum["*"]
+	}
+	clone := *u
+	return &clone
+}
+
+// Has reports whether a base url is configured for host itself.
+func (bum BaseURLMap) Has(host string) bool {
+	host = strings.ToLower(host)
+	if _, ok := bum[host]; ok {
+		return true
+	}
+	hostname, _, err := net.SplitHostPort(host)
+	_, ok := bum[hostname]
+	return err == nil && ok
+}
+
+// PathPrefixes returns the distinct path prefixes, longest first.
+func (bum BaseURLMap) PathPrefixes() []string {
+	prefixes := []string{}
+	for _, u := range bum {
+		if u.Path != "" && !slices.Contains(prefixes, u.Path) {
+			prefixes = append(prefixes, u.Path)
+		}
+	}
+	slices.SortFunc(prefixes, func(a, b string) int {
+		return len(b) - len(a)
+	})
+	return prefixes
+}
+
+func parseBaseURLMap(baseUrl, baseUrlByHost string) (BaseURLMap, error) {
+	defaultBaseUrl, err := parseBaseURL(baseUrl)
+	if err != nil {
+		return nil, errors.New("STREMTHRU_BASE_URL: " + err.Error())
+	}
+	bum := BaseURLMap{"*": defaultBaseUrl}
+	if baseUrlByHost == "" {
+		return bum, nil
+	}
+	valueByHost := map[string]string{}
+	if err := json.Unmarshal([]byte(baseUrlByHost), &valueByHost); err != nil {
+		return nil, errors.New("STREMTHRU_BASE_URL_BY_HOST: " + err.Error())
+	}
+	for host, value := range valueByHost {
+		u, err := parseBaseURL(value)
+		if err != nil {
+			return nil, errors.New("STREMTHRU_BASE_URL_BY_HOST: " + host + ": " + err.Error())
+		}
+		bum[strings.ToLower(host)] = u
+	}
+	return bum, nil
+}
+
+// Whether STREMTHRU_BASE_URL is set, links are built from the request host
+// otherwise
+var IsBaseURLConfigured = func() bool {
+	value, ok := os.LookupEnv("STREMTHRU_BASE_URL")
+	return ok && value != ""
+}()
+
+var PublicBaseURL = func() BaseURLMap {
+	bum, err := parseBaseURLMap(BaseURL, getEnv("STREMTHRU_BASE_URL_BY_HOST"))
+	if err != nil {
+		log.Fatalf("invalid %v", err)
+	}
+	return bum
+}()
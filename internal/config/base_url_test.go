@@ -0,0 +1,39 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type BaseURLTestSuite struct {
+	suite.Suite
+}
+
+func (s *BaseURLTestSuite) TestGet() {
+	bum, err := parseBaseURLMap("https://host.example.com/stremthru/", `{"media.example.org":"https://media.example.org","Other.example.net:8443":"https://other.example.net:8443/st"}`)
+	s.Require().NoError(err)
+
+	s.Equal("https://host.example.com/stremthru", bum.Get("unknown.example").String())
+	s.Equal("https://media.example.org", bum.Get("media.example.org:8080").String())
+	s.Equal("https://other.example.net:8443/st", bum.Get("other.example.net:8443").String())
+	s.True(bum.Has("media.example.org"))
+	s.False(bum.Has("unknown.example"))
+	s.Equal([]string{"/stremthru", "/st"}, bum.PathPrefixes())
+
+	u := bum.Get("unknown.example")
+	u.Host = "changed"
+	s.Equal("host.example.com", bum.Get("unknown.example").Host)
+}
+
+func (s *BaseURLTestSuite) TestInvalid() {
+	_, err := parseBaseURLMap("localhost:8080", "")
+	s.Error(err)
+
+	_, err = parseBaseURLMap("http://localhost:8080", `{"a.example":"ftp://a.example"}`)
+	s.Error(err)
+}
+
+func TestBaseURL(t *testing.T) {
+	suite.Run(t, new(BaseURLTestSuite))
+}
@@ -1,10 +1,14 @@
 package config
 
 import (
+	"errors"
 	"log"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/Dydhzo/stremthru-proxy/core"
 )
@@ -49,7 +53,29 @@ var defaultValueByEnv = map[string]map[string]string{
 		"STREMTHRU_LOG_LEVEL":  "INFO",
 		"STREMTHRU_PORT":       "8080",
 		"STREMTHRU_LANDING_PAGE": "{}",
-		"STREMTHRU_IP_CHECKER": "akamai",
+		"STREMTHRU_IP_CHECKER": "akamai,aws",
+		"STREMTHRU_IP_CHECKER_TTL": "30m",
+		"STREMTHRU_PROXY_REDIRECT_POLICY": "follow",
+		"STREMTHRU_PROXY_MAX_REDIRECTS": "10",
+		"STREMTHRU_PROXY_SSRF_GUARD": "true",
+		"STREMTHRU_PROXY_MAX_BODY_SIZE": "10MB",
+		"STREMTHRU_PROXY_TOKEN_FORMAT": "compact",
+		"STREMTHRU_PROXY_TOKEN_ENCRYPTION": "link",
+		"STREMTHRU_PROXY_TOKEN_CACHE_SIZE": "10000",
+		"STREMTHRU_DATA_DIR": "data",
+		"STREMTHRU_PROXY_LINK_RECORDS": "true",
+		"STREMTHRU_AUTH_FAILURE_LIMIT": "0",
+		"STREMTHRU_AUTH_BAN_DURATION": "1m",
+		"STREMTHRU_AUTH_BAN_MAX_DURATION": "1h",
+		"STREMTHRU_ACCESS_LOG_FORMAT": "combined",
+		"STREMTHRU_ACCESS_LOG_MAX_SIZE": "100MB",
+		"STREMTHRU_ACCESS_LOG_MAX_FILES": "5",
+		"STREMTHRU_AUDIT_LOG_MAX_SIZE": "100MB",
+		"STREMTHRU_AUDIT_LOG_MAX_FILES": "0",
+		"STREMTHRU_AUDIT_LOG_HASH_URLS": "false",
+		"STREMTHRU_TRACING_SAMPLE_RATIO": "1",
+		"STREMTHRU_TRACING_SERVICE_NAME": "stremthru-proxy",
+		"STREMTHRU_TRACING_PROPAGATE": "false",
 	},
 }
 
@@ -130,7 +156,312 @@ var ProxyAuthPassword = func() []string {
 	return passwords
 }()
 var IsPublicInstance = config.IsPublicInstance
+
+// Users allowed to list and revoke the links of every user
+var ProxyAdmins = func() []string {
+	admins := []string{}
+	for _, user := range strings.Split(getEnv("STREMTHRU_PROXY_ADMINS"), ",") {
+		user = strings.TrimSpace(user)
+		if user == "" {
+			continue
+		}
+		if _, ok := ProxyAuth[user]; !ok {
+			log.Fatalf("invalid STREMTHRU_PROXY_ADMINS, unknown user: %s", user)
+		}
+		admins = append(admins, user)
+	}
+	return admins
+}()
+
+func IsProxyAdmin(user string) bool {
+	return slices.Contains(ProxyAdmins, user)
+}
 var LandingPage = getEnv("STREMTHRU_LANDING_PAGE")
+
+// Directory of the files persisted by the server, like the short link store
+var DataDir = getEnv("STREMTHRU_DATA_DIR")
+
+// Whether links created through the API are recorded in DataDir, so they
+// can be listed and revoked
+var ProxyLinkRecords = func() bool {
+	value := getEnv("STREMTHRU_PROXY_LINK_RECORDS")
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Fatalf("invalid STREMTHRU_PROXY_LINK_RECORDS: %s", value)
+	}
+	return enabled
+}()
+
+type RedirectPolicy string
+
+const (
+	REDIRECT_POLICY_FOLLOW      RedirectPolicy = "follow"
+	REDIRECT_POLICY_PASSTHROUGH RedirectPolicy = "passthrough"
+	REDIRECT_POLICY_REJECT      RedirectPolicy = "reject"
+)
+
+// How upstream 30x responses are handled: followed by the proxy, passed
+// through to the client as a new proxy link, or rejected.
+var ProxyRedirectPolicy = func() RedirectPolicy {
+	policy := RedirectPolicy(strings.ToLower(getEnv("STREMTHRU_PROXY_REDIRECT_POLICY")))
+	switch policy {
+	case REDIRECT_POLICY_FOLLOW, REDIRECT_POLICY_PASSTHROUGH, REDIRECT_POLICY_REJECT:
+		return policy
+	default:
+		log.Fatalf("invalid STREMTHRU_PROXY_REDIRECT_POLICY: %s", policy)
+		return ""
+	}
+}()
+
+var ProxyMaxRedirects = func() int {
+	value := getEnv("STREMTHRU_PROXY_MAX_REDIRECTS")
+	maxRedirects, err := strconv.Atoi(value)
+	if err != nil || maxRedirects < 0 {
+		log.Fatalf("invalid STREMTHRU_PROXY_MAX_REDIRECTS: %s", value)
+	}
+	return maxRedirects
+}()
+
+type TokenFormat string
+
+const (
+	TOKEN_FORMAT_COMPACT TokenFormat = "compact"
+	TOKEN_FORMAT_LEGACY  TokenFormat = "legacy"
+)
+
+// Format of newly created proxy link tokens: the compact binary format, or
+// the legacy base64 json / jwt ones. Both are always accepted.
+var ProxyTokenFormat = func() TokenFormat {
+	format := TokenFormat(strings.ToLower(getEnv("STREMTHRU_PROXY_TOKEN_FORMAT")))
+	switch format {
+	case TOKEN_FORMAT_COMPACT, TOKEN_FORMAT_LEGACY:
+		return format
+	default:
+		log.Fatalf("invalid STREMTHRU_PROXY_TOKEN_FORMAT: %s", format)
+		return ""
+	}
+}()
+
+type TokenEncryption string
+
+const (
+	TOKEN_ENCRYPTION_LINK TokenEncryption = "link"
+	TOKEN_ENCRYPTION_FULL TokenEncryption = "full"
+)
+
+// What encrypted tokens hide: the upstream link and headers only, or the
+// whole payload including the user. Full encryption needs compact tokens.
+var ProxyTokenEncryption = func() TokenEncryption {
+	encryption := TokenEncryption(strings.ToLower(getEnv("STREMTHRU_PROXY_TOKEN_ENCRYPTION")))
+	switch encryption {
+	case TOKEN_ENCRYPTION_LINK:
+	case TOKEN_ENCRYPTION_FULL:
+		if ProxyTokenFormat != TOKEN_FORMAT_COMPACT {
+			log.Fatalf("STREMTHRU_PROXY_TOKEN_ENCRYPTION=full requires STREMTHRU_PROXY_TOKEN_FORMAT=compact")
+		}
+	default:
+		log.Fatalf("invalid STREMTHRU_PROXY_TOKEN_ENCRYPTION: %s", encryption)
+	}
+	return encryption
+}()
+
+// Legacy base64 tokens embedding the user password are rejected after this
+// time, zero accepts them forever.
+var ProxyPasswordTokensUntil = func() time.Time {
+	value := getEnv("STREMTHRU_PROXY_PASSWORD_TOKENS_UNTIL")
+	if value == "" {
+		return time.Time{}
+	}
+	if until, err := time.Parse(time.RFC3339, value); err == nil {
+		return until
+	}
+	until, err := time.Parse(time.DateOnly, value)
+	if err != nil {
+		log.Fatalf("invalid STREMTHRU_PROXY_PASSWORD_TOKENS_UNTIL: %s", value)
+	}
+	return until
+}()
+
+var byteSizeUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"GB", 1 << 30},
+	{"MB", 1 << 20},
+	{"KB", 1 << 10},
+	{"B", 1},
+}
+
+// parseByteSize parses a size in bytes, with an optional B, KB, MB or GB suffix
+func parseByteSize(value string) (int64, error) {
+	value = strings.ToUpper(strings.TrimSpace(value))
+	unit := int64(1)
+	for _, u := range byteSizeUnits {
+		if strings.HasSuffix(value, u.suffix) {
+			value, unit = strings.TrimSpace(strings.TrimSuffix(value, u.suffix)), u.size
+			break
+		}
+	}
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || size < 0 {
+		return 0, errors.New("invalid size")
+	}
+	return size * unit, nil
+}
+
+// Largest request body streamed upstream, for links allowing methods with a body.
+var ProxyMaxBodySize = func() int64 {
+	value := getEnv("STREMTHRU_PROXY_MAX_BODY_SIZE")
+	size, err := parseByteSize(value)
+	if err != nil {
+		log.Fatalf("invalid STREMTHRU_PROXY_MAX_BODY_SIZE: %s", value)
+	}
+	return size
+}()
+
+// ClientGuardConfig bans client ips repeating auth or token failures, for
+// BanDuration doubled on each new ban up to MaxBanDuration
+type ClientGuardConfig struct {
+	// Failures within FailureWindow before a ban, zero disables bans
+	FailureLimit   int
+	FailureWindow  time.Duration
+	BanDuration    time.Duration
+	MaxBanDuration time.Duration
+}
+
+var ClientGuard = func() ClientGuardConfig {
+	cg := ClientGuardConfig{FailureWindow: 10 * time.Minute}
+	value := getEnv("STREMTHRU_AUTH_FAILURE_LIMIT")
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit < 0 {
+		log.Fatalf("invalid STREMTHRU_AUTH_FAILURE_LIMIT: %s", value)
+	}
+	cg.FailureLimit = limit
+	for name, d := range map[string]*time.Duration{
+		"STREMTHRU_AUTH_BAN_DURATION":     &cg.BanDuration,
+		"STREMTHRU_AUTH_BAN_MAX_DURATION": &cg.MaxBanDuration,
+	} {
+		value := getEnv(name)
+		duration, err := time.ParseDuration(value)
+		if err != nil || duration <= 0 {
+			log.Fatalf("invalid %s: %s", name, value)
+		}
+		*d = duration
+	}
+	if cg.MaxBanDuration < cg.BanDuration {
+		cg.MaxBanDuration = cg.BanDuration
+	}
+	return cg
+}()
+
+// LogFileConfig is a log file rotated once it reaches MaxSize, keeping
+// MaxFiles rotated files, all of them when zero
+type LogFileConfig struct {
+	// Empty disables the log
+	File     string
+	MaxSize  int64
+	MaxFiles int
+}
+
+func parseLogFileConfig(prefix string) LogFileConfig {
+	c := LogFileConfig{File: getEnv(prefix + "_FILE")}
+	value := getEnv(prefix + "_MAX_SIZE")
+	size, err := parseByteSize(value)
+	if err != nil || size == 0 {
+		log.Fatalf("invalid %s_MAX_SIZE: %s", prefix, value)
+	}
+	c.MaxSize = size
+	value = getEnv(prefix + "_MAX_FILES")
+	maxFiles, err := strconv.Atoi(value)
+	if err != nil || maxFiles < 0 {
+		log.Fatalf("invalid %s_MAX_FILES: %s", prefix, value)
+	}
+	c.MaxFiles = maxFiles
+	return c
+}
+
+type AccessLogFormat string
+
+const (
+	ACCESS_LOG_FORMAT_COMBINED AccessLogFormat = "combined"
+	ACCESS_LOG_FORMAT_JSON     AccessLogFormat = "json"
+)
+
+// AccessLogConfig is the log of every request, written once its response
+// is fully sent
+type AccessLogConfig struct {
+	LogFileConfig
+	Format AccessLogFormat
+}
+
+var AccessLog = func() AccessLogConfig {
+	c := AccessLogConfig{LogFileConfig: parseLogFileConfig("STREMTHRU_ACCESS_LOG")}
+	c.Format = AccessLogFormat(strings.ToLower(getEnv("STREMTHRU_ACCESS_LOG_FORMAT")))
+	switch c.Format {
+	case ACCESS_LOG_FORMAT_COMBINED, ACCESS_LOG_FORMAT_JSON:
+	default:
+		log.Fatalf("invalid STREMTHRU_ACCESS_LOG_FORMAT: %s", c.Format)
+	}
+	return c
+}()
+
+// AuditLogConfig is the audit trail of link creations, accesses and revocations
+type AuditLogConfig struct {
+	LogFileConfig
+	// Log a keyed hash of upstream urls instead of the urls
+	HashURLs bool
+}
+
+var AuditLog = func() AuditLogConfig {
+	c := AuditLogConfig{LogFileConfig: parseLogFileConfig("STREMTHRU_AUDIT_LOG")}
+	value := getEnv("STREMTHRU_AUDIT_LOG_HASH_URLS")
+	hashURLs, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Fatalf("invalid STREMTHRU_AUDIT_LOG_HASH_URLS: %s", value)
+	}
+	c.HashURLs = hashURLs
+	return c
+}()
+
+// TracingConfig exports OpenTelemetry traces over OTLP/HTTP
+type TracingConfig struct {
+	// OTLP/HTTP endpoint url, empty disables tracing
+	Endpoint    string
+	SampleRatio float64
+	ServiceName string
+	// Whether the traceparent of clients is continued and sent upstream
+	Propagate bool
+}
+
+var Tracing = func() TracingConfig {
+	c := TracingConfig{
+		Endpoint:    getEnv("STREMTHRU_TRACING_ENDPOINT"),
+		ServiceName: getEnv("STREMTHRU_TRACING_SERVICE_NAME"),
+	}
+	value := getEnv("STREMTHRU_TRACING_SAMPLE_RATIO")
+	ratio, err := strconv.ParseFloat(value, 64)
+	if err != nil || ratio < 0 || ratio > 1 {
+		log.Fatalf("invalid STREMTHRU_TRACING_SAMPLE_RATIO: %s", value)
+	}
+	c.SampleRatio = ratio
+	value = getEnv("STREMTHRU_TRACING_PROPAGATE")
+	propagate, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Fatalf("invalid STREMTHRU_TRACING_PROPAGATE: %s", value)
+	}
+	c.Propagate = propagate
+	return c
+}()
+
+// Number of decoded proxy link tokens kept in memory
+var ProxyTokenCacheSize = func() int {
+	value := getEnv("STREMTHRU_PROXY_TOKEN_CACHE_SIZE")
+	size, err := strconv.Atoi(value)
+	if err != nil || size < 1 {
+		log.Fatalf("invalid STREMTHRU_PROXY_TOKEN_CACHE_SIZE: %s", value)
+	}
+	return size
+}()
 var Version = "v1.0.0"
 
 func PrintConfig(state *AppState) {
@@ -139,13 +470,54 @@ func PrintConfig(state *AppState) {
 	l.Println("=== StremThru Proxy ===")
 	l.Println()
 	l.Println(" Proxy:")
-	l.Println("   base_url: " + BaseURL)
+	if IsBaseURLConfigured {
+		l.Println("   base_url: " + PublicBaseURL.Get("*").String())
+	} else {
+		l.Println("   base_url: (request host)")
+	}
+	if len(PublicBaseURL) > 1 {
+		l.Println("             (+" + strconv.Itoa(len(PublicBaseURL)-1) + " by host)")
+	}
 	l.Println("      port: " + Port)
 	l.Println("  log_level: " + LogLevel)
 	l.Println(" log_format: " + LogFormat)
+	l.Println("   redirect: " + string(ProxyRedirectPolicy) + " (max " + strconv.Itoa(ProxyMaxRedirects) + ")")
+	if p := ProxyLinkExpiry.Get("*"); p.Default != 0 || p.Max != 0 {
+		l.Println("     expiry: default " + p.Default.String() + ", max " + p.Max.String())
+	}
+	if SSRF.IsEnabled() {
+		l.Println(" ssrf_guard: enabled")
+	} else {
+		l.Println(" ssrf_guard: disabled")
+	}
+
+	if Tracing.Endpoint != "" {
+		propagation := ""
+		if Tracing.Propagate {
+			propagation = ", propagated"
+		}
+		l.Println("    tracing: " + Tracing.Endpoint + " (sample " + strconv.FormatFloat(Tracing.SampleRatio, 'f', -1, 64) + propagation + ")")
+	}
+	if AccessLog.File != "" {
+		l.Println("     access: " + AccessLog.File + " (" + string(AccessLog.Format) + ")")
+	}
+	if AuditLog.File != "" {
+		l.Println("      audit: " + AuditLog.File)
+	}
 
 	if len(ProxyAuth) > 0 {
 		l.Println("      users:", len(ProxyAuth))
+		if len(ProxyAdmins) > 0 {
+			l.Println("     admins: " + strings.Join(ProxyAdmins, ", "))
+		}
+		if ClientGuard.FailureLimit > 0 {
+			l.Println("   auth_ban: after " + strconv.Itoa(ClientGuard.FailureLimit) + " failures, " + ClientGuard.BanDuration.String() + " up to " + ClientGuard.MaxBanDuration.String())
+			if len(TrustedProxy) == 0 {
+				l.Println("             warning: no trusted proxies, clients behind a reverse proxy share its ip and its bans")
+			}
+		} else {
+			l.Println("   auth_ban: disabled")
+		}
 	} else {
 		l.Println("  auth: disabled (public)")
 	}
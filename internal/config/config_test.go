@@ -0,0 +1,33 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type ConfigTestSuite struct {
+	suite.Suite
+}
+
+func (s *ConfigTestSuite) TestParseByteSize() {
+	for value, expected := range map[string]int64{
+		"1024":  1024,
+		"10MB":  10 << 20,
+		"2 gb":  2 << 30,
+		"512KB": 512 << 10,
+		"0B":    0,
+	} {
+		size, err := parseByteSize(value)
+		s.NoError(err, value)
+		s.Equal(expected, size, value)
+	}
+	for _, value := range []string{"", "MB", "-1", "1TB"} {
+		_, err := parseByteSize(value)
+		s.Error(err, value)
+	}
+}
+
+func TestConfig(t *testing.T) {
+	suite.Run(t, new(ConfigTestSuite))
+}
@@ -0,0 +1,76 @@
+package config
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Hop-by-hop headers from RFC 9110 section 7.6.1, plus the non-standard
+// ones still seen in the wild. They only describe a single connection.
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// RemoveHopByHopHeaders deletes the hop-by-hop headers from header, including
+// the ones listed in its Connection header.
+func RemoveHopByHopHeaders(header http.Header) {
+	for _, value := range header.Values("Connection") {
+		for _, key := range strings.Split(value, ",") {
+			if key = strings.TrimSpace(key); key != "" {
+				header.Del(key)
+			}
+		}
+	}
+	for _, key := range hopByHopHeaders {
+		header.Del(key)
+	}
+}
+
+// HeaderFilter decides which client request headers are forwarded upstream.
+// With an allowlist only the listed headers pass, the denylist always wins.
+type HeaderFilter struct {
+	allow map[string]struct{}
+	deny  map[string]struct{}
+}
+
+func (f *HeaderFilter) IsAllowed(key string) bool {
+	key = http.CanonicalHeaderKey(key)
+	if _, denied := f.deny[key]; denied {
+		return false
+	}
+	if len(f.allow) == 0 {
+		return true
+	}
+	_, allowed := f.allow[key]
+	return allowed
+}
+
+func parseHeaderList(value string) map[string]struct{} {
+	headers := map[string]struct{}{}
+	for _, key := range strings.Split(value, ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			headers[http.CanonicalHeaderKey(key)] = struct{}{}
+		}
+	}
+	return headers
+}
+
+func parseHeaderFilter(allow, deny string) *HeaderFilter {
+	return &HeaderFilter{
+		allow: parseHeaderList(allow),
+		deny:  parseHeaderList(deny),
+	}
+}
+
+var ProxyForwardHeaders = parseHeaderFilter(
+	getEnv("STREMTHRU_PROXY_FORWARD_HEADERS_ALLOW"),
+	getEnv("STREMTHRU_PROXY_FORWARD_HEADERS_DENY"),
+)
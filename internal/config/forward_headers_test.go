@@ -0,0 +1,43 @@
+package config
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type ForwardHeadersTestSuite struct {
+	suite.Suite
+}
+
+func (s *ForwardHeadersTestSuite) TestRemoveHopByHopHeaders() {
+	header := http.Header{}
+	header.Set("Connection", "keep-alive, X-Custom-Hop")
+	header.Set("Keep-Alive", "timeout=5")
+	header.Set("Upgrade", "websocket")
+	header.Set("Proxy-Authorization", "Basic dXNlcjpwYXNz")
+	header.Set("X-Custom-Hop", "1")
+	header.Set("Range", "bytes=0-")
+
+	RemoveHopByHopHeaders(header)
+
+	s.Equal(http.Header{"Range": {"bytes=0-"}}, header)
+}
+
+func (s *ForwardHeadersTestSuite) TestHeaderFilter() {
+	f := parseHeaderFilter("", "referer, x-debug")
+	s.True(f.IsAllowed("Range"))
+	s.False(f.IsAllowed("Referer"))
+	s.False(f.IsAllowed("X-Debug"))
+
+	f = parseHeaderFilter("range,user-agent,referer", "Referer")
+	s.True(f.IsAllowed("Range"))
+	s.True(f.IsAllowed("user-agent"))
+	s.False(f.IsAllowed("Referer"))
+	s.False(f.IsAllowed("Cookie"))
+}
+
+func TestForwardHeaders(t *testing.T) {
+	suite.Run(t, new(ForwardHeadersTestSuite))
+}
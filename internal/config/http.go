@@ -2,8 +2,10 @@ package config
 
 import (
 	"errors"
+	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
@@ -76,6 +78,30 @@ func (tm TunnelMap) forcedProxy(r *http.Request) (*url.URL, error) {
 	return nil, nil
 }
 
+var tunnelTypeByName = map[string]TunnelType{
+	"none":   TUNNEL_TYPE_NONE,
+	"auto":   TUNNEL_TYPE_AUTO,
+	"forced": TUNNEL_TYPE_FORCED,
+}
+
+// ParseTunnelType parses a tunnel type name: none, auto or forced
+func ParseTunnelType(name string) (TunnelType, error) {
+	if tunnelType, ok := tunnelTypeByName[strings.ToLower(name)]; ok {
+		return tunnelType, nil
+	}
+	return TUNNEL_TYPE_NONE, errors.New("invalid tunnel type: " + name)
+}
+
+// Name returns the tunnel type name accepted by ParseTunnelType
+func (tt TunnelType) Name() string {
+	for name, tunnelType := range tunnelTypeByName {
+		if tunnelType == tt {
+			return name
+		}
+	}
+	return string(tt)
+}
+
 func (tm TunnelMap) GetProxy(tunnelType TunnelType) func(req *http.Request) (*url.URL, error) {
 	switch tunnelType {
 	case TUNNEL_TYPE_AUTO:
@@ -206,85 +232,111 @@ func getHTTPClientWithProxy(proxyUrl *url.URL) *http.Client {
 	}
 }
 
+// IPResolverStatus describes the outcome of the last ip resolution
+type IPResolverStatus struct {
+	Checker    string
+	CheckedAt  time.Time
+	StaleAt    time.Time
+	Refreshing bool
+	Errors     []error
+}
+
 type IPResolver struct {
-	machineIP string
+	checkers []string
+	ttl      time.Duration
 
-	checker            string
+	machineIP          string
 	proxyIpByHostname  map[string]string
 	proxyIpByProxyHost map[string]string
-	proxyIpMapStaleAt  time.Time
+	status             IPResolverStatus
 	m                  sync.Mutex
+
+	// serializes network lookups, so concurrent callers share one resolution
+	refreshM sync.Mutex
 }
 
-func (ipr *IPResolver) getIp(client *http.Client) (string, error) {
-	switch ipr.checker {
-	case "aws", "amazon":
-		req, err := http.NewRequest(http.MethodGet, "https://checkip.amazonaws.com", nil)
-		if err != nil {
-			return "", err
-		}
-		res, err := client.Do(req)
-		if err != nil {
-			return "", err
-		}
-		body, err := io.ReadAll(res.Body)
-		if err != nil {
-			return "", err
-		}
-		return strings.TrimSpace(string(body)), nil
-	case "akamai":
-		req, err := http.NewRequest(http.MethodGet, "https://whatismyip.akamai.com", nil)
-		if err != nil {
-			return "", err
-		}
-		res, err := client.Do(req)
-		if err != nil {
-			return "", err
-		}
-		body, err := io.ReadAll(res.Body)
-		if err != nil {
-			return "", err
-		}
-		return strings.TrimSpace(string(body)), nil
-	default:
-		return "", errors.New("invalid ip checker: " + ipr.checker)
-	}
+var ipCheckerUrlByName = map[string]string{
+	"akamai": "https://whatismyip.akamai.com",
+	"amazon": "https://checkip.amazonaws.com",
+	"aws":    "https://checkip.amazonaws.com",
 }
 
-func (ipr *IPResolver) GetMachineIP() string {
-	if ipr.machineIP == "" {
-		client := GetHTTPClient(TUNNEL_TYPE_NONE)
-		client.Timeout = 30 * time.Second
-		ip, err := ipr.getIp(client)
-		if err != nil {
-			log.Panicf("Failed to detect Machine IP: %v\n", err)
-		}
-		ipr.machineIP = ip
+// Accepts a known checker name or an http(s) url returning the ip as plain text.
+func getIpCheckerUrl(checker string) (string, error) {
+	if checkerUrl, ok := ipCheckerUrlByName[checker]; ok {
+		return checkerUrl, nil
 	}
-	return ipr.machineIP
+	if u, err := url.Parse(checker); err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" {
+		return u.String(), nil
+	}
+	return "", errors.New("invalid ip checker: " + checker)
 }
 
-func (ipr *IPResolver) GetTunnelIP() (string, error) {
-	client := GetHTTPClient(TUNNEL_TYPE_FORCED)
-	client.Timeout = 30 * time.Second
-	ip, err := ipr.getIp(client)
+func getIpFromChecker(client *http.Client, checker string) (string, error) {
+	checkerUrl, err := getIpCheckerUrl(checker)
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest(http.MethodGet, checkerUrl, nil)
+	if err != nil {
+		return "", err
+	}
+	res, err := client.Do(req)
 	if err != nil {
 		return "", err
 	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", errors.New("unexpected ip checker status: " + res.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(res.Body, 256))
+	if err != nil {
+		return "", err
+	}
+	ip := strings.TrimSpace(string(body))
+	if net.ParseIP(ip) == nil {
+		return "", errors.New("invalid ip checker response: " + ip)
+	}
 	return ip, nil
 }
 
-func (ipr *IPResolver) resolveTunnelIPMap() error {
-	ipr.m.Lock()
-	defer ipr.m.Unlock()
+// Tries each checker in order, returning the first ip found.
+func (ipr *IPResolver) getIp(client *http.Client) (ip string, checker string, err error) {
+	if len(ipr.checkers) == 0 {
+		return "", "", errors.New("no ip checker configured")
+	}
+	errs := []error{}
+	for _, checker := range ipr.checkers {
+		ip, err := getIpFromChecker(client, checker)
+		if err == nil {
+			return ip, checker, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", checker, err))
+	}
+	return "", "", errors.Join(errs...)
+}
 
-	if !ipr.proxyIpMapStaleAt.Before(time.Now()) {
-		return nil
+func (ipr *IPResolver) refresh() {
+	ipr.refreshM.Lock()
+	defer ipr.refreshM.Unlock()
+
+	ipr.m.Lock()
+	isFresh := !ipr.status.CheckedAt.IsZero() && time.Now().Before(ipr.status.StaleAt)
+	ipr.m.Unlock()
+	if isFresh {
+		return
 	}
 
+	client := GetHTTPClient(TUNNEL_TYPE_NONE)
+	client.Timeout = 10 * time.Second
+	machineIP, checker, machineIpErr := ipr.getIp(client)
+
 	proxyIpByProxyHost := map[string]string{}
 	proxyIpByHostname := map[string]string{}
 	errs := []error{}
+	if machineIpErr != nil {
+		errs = append(errs, fmt.Errorf("machine: %w", machineIpErr))
+	}
 
 	for hostname, u := range Tunnel {
 		if ip, ok := proxyIpByProxyHost[u.Host]; ok {
@@ -293,14 +345,14 @@ func (ipr *IPResolver) resolveTunnelIPMap() error {
 		}
 		var ip string
 		if u.Host == "" {
-			ip = ipr.GetMachineIP()
+			ip = machineIP
 		} else {
 			client := getHTTPClientWithProxy(&u)
-			client.Timeout = 30 * time.Second
-			if proxyIp, err := ipr.getIp(client); err == nil {
+			client.Timeout = 10 * time.Second
+			if proxyIp, _, err := ipr.getIp(client); err == nil {
 				ip = proxyIp
 			} else {
-				errs = append(errs, err)
+				errs = append(errs, fmt.Errorf("%s: %w", u.Host, err))
 			}
 		}
 		proxyIpByHostname[hostname] = ip
@@ -309,23 +361,100 @@ func (ipr *IPResolver) resolveTunnelIPMap() error {
 
 	delete(proxyIpByProxyHost, "")
 
+	now := time.Now()
+	staleAt := now.Add(ipr.ttl)
+	if len(errs) > 0 {
+		// retry failures sooner than the regular ttl
+		staleAt = now.Add(min(ipr.ttl, time.Minute))
+	}
+
+	ipr.m.Lock()
+	defer ipr.m.Unlock()
+
+	// keep the last known machine ip on a transient failure
+	if machineIpErr == nil || ipr.machineIP == "" {
+		ipr.machineIP = machineIP
+	}
 	ipr.proxyIpByHostname = proxyIpByHostname
 	ipr.proxyIpByProxyHost = proxyIpByProxyHost
-	ipr.proxyIpMapStaleAt = time.Now().Add(30 * time.Minute)
+	ipr.status = IPResolverStatus{
+		Checker:   checker,
+		CheckedAt: now,
+		StaleAt:   staleAt,
+		Errors:    errs,
+	}
+}
+
+// Resolves synchronously the first time, after that stale results are
+// served while a refresh runs in the background.
+func (ipr *IPResolver) resolve() {
+	ipr.m.Lock()
+	isResolved := !ipr.status.CheckedAt.IsZero()
+	shouldRefresh := isResolved && !ipr.status.Refreshing && !time.Now().Before(ipr.status.StaleAt)
+	if shouldRefresh {
+		ipr.status.Refreshing = true
+	}
+	ipr.m.Unlock()
+
+	if !isResolved {
+		ipr.refresh()
+	} else if shouldRefresh {
+		go func() {
+			ipr.refresh()
+			ipr.m.Lock()
+			ipr.status.Refreshing = false
+			ipr.m.Unlock()
+		}()
+	}
+}
 
-	return errors.Join(errs...)
+// GetMachineIP returns the ip of the machine without any tunnel
+func (ipr *IPResolver) GetMachineIP() (string, error) {
+	ipr.resolve()
+	ipr.m.Lock()
+	defer ipr.m.Unlock()
+	if ipr.machineIP == "" {
+		return "", errors.Join(ipr.status.Errors...)
+	}
+	return ipr.machineIP, nil
 }
 
+// GetTunnelIPByProxyHost returns the egress ip for each configured tunnel proxy host
 func (ipr *IPResolver) GetTunnelIPByProxyHost() (map[string]string, error) {
-	err := ipr.resolveTunnelIPMap()
-	return ipr.proxyIpByProxyHost, err
+	ipr.resolve()
+	ipr.m.Lock()
+	defer ipr.m.Unlock()
+	return ipr.proxyIpByProxyHost, errors.Join(ipr.status.Errors...)
 }
 
+// GetTunnelIPByHostname returns the ip exposed to upstream for each tunnel hostname rule
 func (ipr *IPResolver) GetTunnelIPByHostname() (map[string]string, error) {
-	err := ipr.resolveTunnelIPMap()
-	return ipr.proxyIpByHostname, err
+	ipr.resolve()
+	ipr.m.Lock()
+	defer ipr.m.Unlock()
+	return ipr.proxyIpByHostname, errors.Join(ipr.status.Errors...)
 }
 
-var IP = &IPResolver{
-	checker: getEnv("STREMTHRU_IP_CHECKER"),
+// GetStatus returns the state of the last ip resolution
+func (ipr *IPResolver) GetStatus() IPResolverStatus {
+	ipr.m.Lock()
+	defer ipr.m.Unlock()
+	return ipr.status
 }
+
+var IP = func() *IPResolver {
+	ttl, err := time.ParseDuration(getEnv("STREMTHRU_IP_CHECKER_TTL"))
+	if err != nil || ttl <= 0 {
+		log.Fatalf("invalid STREMTHRU_IP_CHECKER_TTL: %s", getEnv("STREMTHRU_IP_CHECKER_TTL"))
+	}
+	checkers := strings.FieldsFunc(getEnv("STREMTHRU_IP_CHECKER"), func(c rune) bool {
+		return c == ','
+	})
+	for i := range checkers {
+		checkers[i] = strings.TrimSpace(checkers[i])
+	}
+	return &IPResolver{
+		checkers: checkers,
+		ttl:      ttl,
+	}
+}()
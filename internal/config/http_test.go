@@ -2,9 +2,11 @@ package config
 
 import (
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/suite"
 )
@@ -77,3 +79,66 @@ func (s *TunnelTestSuite) TestDefaultOn() {
 func TestTunnel(t *testing.T) {
 	suite.Run(t, new(TunnelTestSuite))
 }
+
+type IPResolverTestSuite struct {
+	suite.Suite
+}
+
+func (s *IPResolverTestSuite) TestLocalChecker() {
+	checker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("203.0.113.7\n"))
+	}))
+	defer checker.Close()
+
+	ipr := &IPResolver{checkers: []string{checker.URL}, ttl: time.Minute}
+
+	ip, err := ipr.GetMachineIP()
+	s.Nil(err)
+	s.Equal("203.0.113.7", ip)
+
+	exposed, err := ipr.GetTunnelIPByHostname()
+	s.Nil(err)
+	s.Equal("203.0.113.7", exposed["*"])
+
+	status := ipr.GetStatus()
+	s.Equal(checker.URL, status.Checker)
+	s.False(status.CheckedAt.IsZero())
+	s.Empty(status.Errors)
+}
+
+func (s *IPResolverTestSuite) TestCheckerFallback() {
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer broken.Close()
+	checker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("2001:db8::1"))
+	}))
+	defer checker.Close()
+
+	ipr := &IPResolver{checkers: []string{"ftp://example.com", broken.URL, checker.URL}, ttl: time.Minute}
+
+	ip, err := ipr.GetMachineIP()
+	s.Nil(err)
+	s.Equal("2001:db8::1", ip)
+	s.Equal(checker.URL, ipr.GetStatus().Checker)
+}
+
+func (s *IPResolverTestSuite) TestUnreachableChecker() {
+	checker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	checker.Close()
+
+	ipr := &IPResolver{checkers: []string{checker.URL}, ttl: time.Hour}
+
+	ip, err := ipr.GetMachineIP()
+	s.NotNil(err)
+	s.Equal("", ip)
+
+	status := ipr.GetStatus()
+	s.NotEmpty(status.Errors)
+	s.Equal(status.CheckedAt.Add(time.Minute), status.StaleAt)
+}
+
+func TestIPResolver(t *testing.T) {
+	suite.Run(t, new(IPResolverTestSuite))
+}
@@ -0,0 +1,131 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"strconv"
+	"time"
+)
+
+// LinkExpiryPolicy bounds the expiration of the links created by a user
+type LinkExpiryPolicy struct {
+	// Expiration of links created without one, zero never expires
+	Default time.Duration
+	// Longest expiration accepted, zero is unlimited
+	Max time.Duration
+	// Refuse links without expiration when accessed, for links created
+	// before the policy
+	RequireExpiry bool
+}
+
+// linkExpiryPolicyInput is a policy as configured, unset fields are
+// inherited from the server-wide policy
+type linkExpiryPolicyInput struct {
+	Default       *string `json:"default"`
+	Max           *string `json:"max"`
+	RequireExpiry *bool   `json:"require_expiry"`
+}
+
+// parseLinkExpiry parses a duration like "6h", or a number of seconds
+func parseLinkExpiry(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return 0, errors.New("invalid duration: " + value)
+	}
+	return d, nil
+}
+
+func (p LinkExpiryPolicy) validate() error {
+	if p.Max != 0 && p.Default > p.Max {
+		return errors.New("default exceeds max")
+	}
+	return nil
+}
+
+func (input *linkExpiryPolicyInput) merge(p LinkExpiryPolicy) (LinkExpiryPolicy, error) {
+	var err error
+	if input.Default != nil {
+		if p.Default, err = parseLinkExpiry(*input.Default); err != nil {
+			return p, err
+		}
+	}
+	if input.Max != nil {
+		if p.Max, err = parseLinkExpiry(*input.Max); err != nil {
+			return p, err
+		}
+	}
+	if input.RequireExpiry != nil {
+		p.RequireExpiry = *input.RequireExpiry
+	}
+	return p, p.validate()
+}
+
+// LinkExpiryPolicyMap holds the policies by user, "*" being the server-wide one
+type LinkExpiryPolicyMap map[string]LinkExpiryPolicy
+
+func (m LinkExpiryPolicyMap) Get(user string) LinkExpiryPolicy {
+	if p, ok := m[user]; ok {
+		return p
+	}
+	return m["*"]
+}
+
+func parseLinkExpiryPolicies(defaultValue, maxValue, requireExpiry, byUser string) (LinkExpiryPolicyMap, error) {
+	input := &linkExpiryPolicyInput{Default: &defaultValue, Max: &maxValue}
+	if requireExpiry != "" {
+		value, err := strconv.ParseBool(requireExpiry)
+		if err != nil {
+			return nil, errors.New("invalid require expiry: " + requireExpiry)
+		}
+		input.RequireExpiry = &value
+	}
+	serverPolicy, err := input.merge(LinkExpiryPolicy{})
+	if err != nil {
+		return nil, err
+	}
+
+	m := LinkExpiryPolicyMap{"*": serverPolicy}
+	if byUser == "" {
+		return m, nil
+	}
+	inputByUser := map[string]*linkExpiryPolicyInput{}
+	if err := json.Unmarshal([]byte(byUser), &inputByUser); err != nil {
+		return nil, err
+	}
+	for user, input := range inputByUser {
+		if input == nil {
+			continue
+		}
+		p, err := input.merge(serverPolicy)
+		if err != nil {
+			return nil, errors.New(user + ": " + err.Error())
+		}
+		m[user] = p
+	}
+	return m, nil
+}
+
+var ProxyLinkExpiry = func() LinkExpiryPolicyMap {
+	m, err := parseLinkExpiryPolicies(
+		getEnv("STREMTHRU_PROXY_LINK_EXPIRY_DEFAULT"),
+		getEnv("STREMTHRU_PROXY_LINK_EXPIRY_MAX"),
+		getEnv("STREMTHRU_PROXY_LINK_EXPIRY_REQUIRED"),
+		getEnv("STREMTHRU_PROXY_LINK_EXPIRY_BY_USER"),
+	)
+	if err != nil {
+		log.Fatalf("invalid link expiry policy: %v", err)
+	}
+	for user := range m {
+		if _, ok := ProxyAuth[user]; !ok && user != "*" {
+			log.Fatalf("invalid STREMTHRU_PROXY_LINK_EXPIRY_BY_USER, unknown user: %s", user)
+		}
+	}
+	return m
+}()
@@ -0,0 +1,43 @@
+package config
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type LinkExpiryTestSuite struct {
+	suite.Suite
+}
+
+func (s *LinkExpiryTestSuite) TestParse() {
+	m, err := parseLinkExpiryPolicies("6h", "86400", "", `{"alice":{"max":"1h","default":"30m","require_expiry":true},"bob":{"max":""}}`)
+	s.Require().NoError(err)
+
+	s.Equal(LinkExpiryPolicy{Default: 6 * time.Hour, Max: 24 * time.Hour}, m.Get("other"))
+	s.Equal(LinkExpiryPolicy{Default: 30 * time.Minute, Max: time.Hour, RequireExpiry: true}, m.Get("alice"))
+	s.Equal(LinkExpiryPolicy{Default: 6 * time.Hour}, m.Get("bob"))
+
+	m, err = parseLinkExpiryPolicies("", "", "", "")
+	s.Require().NoError(err)
+	s.Equal(LinkExpiryPolicy{}, m.Get("other"))
+}
+
+func (s *LinkExpiryTestSuite) TestInvalid() {
+	_, err := parseLinkExpiryPolicies("2h", "1h", "", "")
+	s.Error(err)
+
+	_, err = parseLinkExpiryPolicies("", "1h", "", `{"alice":{"default":"2h"}}`)
+	s.Error(err)
+
+	_, err = parseLinkExpiryPolicies("1d", "", "", "")
+	s.Error(err)
+
+	_, err = parseLinkExpiryPolicies("", "", "maybe", "")
+	s.Error(err)
+}
+
+func TestLinkExpiry(t *testing.T) {
+	suite.Run(t, new(LinkExpiryTestSuite))
+}
@@ -0,0 +1,224 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+)
+
+// Headers used for tracking or reporting the client, removed by StripTracking.
+var trackingResponseHeaders = []string{
+	"Nel",
+	"P3p",
+	"Report-To",
+	"Reporting-Endpoints",
+	"Server-Timing",
+	"Timing-Allow-Origin",
+	"Tk",
+}
+
+// Headers that describe the connection or the body framing, never overridden.
+var protectedResponseHeaders = []string{
+	"Connection",
+	"Content-Length",
+	"Content-Range",
+	"Keep-Alive",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// ResponseHeaderRules describes changes applied to the upstream response headers
+type ResponseHeaderRules struct {
+	ContentType        string            `json:"content_type,omitempty"`
+	ContentDisposition string            `json:"content_disposition,omitempty"`
+	StripCookies       bool              `json:"strip_cookies,omitempty"`
+	StripTracking      bool              `json:"strip_tracking,omitempty"`
+	Strip              []string          `json:"strip,omitempty"`
+	Set                map[string]string `json:"set,omitempty"`
+}
+
+func (rules *ResponseHeaderRules) Validate() error {
+	switch rules.ContentDisposition {
+	case "", "inline", "attachment", "none":
+	default:
+		return errors.New("invalid content_disposition: " + rules.ContentDisposition)
+	}
+	for key := range rules.Set {
+		key = http.CanonicalHeaderKey(key)
+		if key == "" || strings.ContainsAny(key, " :\r\n") {
+			return errors.New("invalid header: " + key)
+		}
+		if slices.Contains(protectedResponseHeaders, key) {
+			return errors.New("can not set header: " + key)
+		}
+	}
+	for _, value := range rules.Set {
+		if strings.ContainsAny(value, "\r\n") {
+			return errors.New("invalid header value")
+		}
+	}
+	return nil
+}
+
+// Merge returns rules layered on top of base, rules winning on conflicts
+func (rules *ResponseHeaderRules) Merge(base *ResponseHeaderRules) *ResponseHeaderRules {
+	if rules == nil {
+		return base
+	}
+	if base == nil {
+		return rules
+	}
+	merged := &ResponseHeaderRules{
+		ContentType:        base.ContentType,
+		ContentDisposition: base.ContentDisposition,
+		StripCookies:       base.StripCookies || rules.StripCookies,
+		StripTracking:      base.StripTracking || rules.StripTracking,
+		Strip:              append(slices.Clone(base.Strip), rules.Strip...),
+		Set:                map[string]string{},
+	}
+	if rules.ContentType != "" {
+		merged.ContentType = rules.ContentType
+	}
+	if rules.ContentDisposition != "" {
+		merged.ContentDisposition = rules.ContentDisposition
+	}
+	for k, v := range base.Set {
+		merged.Set[http.CanonicalHeaderKey(k)] = v
+	}
+	for k, v := range rules.Set {
+		merged.Set[http.CanonicalHeaderKey(k)] = v
+	}
+	return merged
+}
+
+// Apply rewrites header, filename is the name the link was accessed with.
+// Without rules a filename still sets an inline Content-Disposition, and a
+// Content-Type guessed from its extension if upstream sent a generic one.
+func (rules *ResponseHeaderRules) Apply(header http.Header, filename string) {
+	if rules == nil {
+		rules = &ResponseHeaderRules{}
+	}
+	if rules.StripCookies {
+		header.Del("Set-Cookie")
+		header.Del("Set-Cookie2")
+	}
+	if rules.StripTracking {
+		for _, key := range trackingResponseHeaders {
+			header.Del(key)
+		}
+	}
+	for _, key := range rules.Strip {
+		if !slices.Contains(protectedResponseHeaders, http.CanonicalHeaderKey(key)) {
+			header.Del(key)
+		}
+	}
+	if rules.ContentType != "" {
+		header.Set("Content-Type", rules.ContentType)
+	} else if filename != "" && isGenericContentType(header.Get("Content-Type")) {
+		if contentType := guessContentType(filename); contentType != "" {
+			header.Set("Content-Type", contentType)
+		}
+	}
+	if filename != "" && rules.ContentDisposition != "none" {
+		disposition := rules.ContentDisposition
+		if disposition == "" {
+			disposition = "inline"
+		}
+		header.Set("Content-Disposition", FormatContentDisposition(disposition, filename))
+	}
+	for k, v := range rules.Set {
+		header.Set(k, v)
+	}
+}
+
+func isGenericContentType(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	return mediaType == "" || mediaType == "application/octet-stream" || mediaType == "binary/octet-stream"
+}
+
+// Media types missing from the mime package builtin table.
+var contentTypeByExtension = map[string]string{
+	".ass":  "text/x-ssa",
+	".avi":  "video/x-msvideo",
+	".flac": "audio/flac",
+	".m3u8": "application/vnd.apple.mpegurl",
+	".m4a":  "audio/mp4",
+	".m4v":  "video/x-m4v",
+	".mkv":  "video/x-matroska",
+	".mov":  "video/quicktime",
+	".mp3":  "audio/mpeg",
+	".mp4":  "video/mp4",
+	".mpd":  "application/dash+xml",
+	".srt":  "application/x-subrip",
+	".ts":   "video/mp2t",
+	".vtt":  "text/vtt",
+	".webm": "video/webm",
+}
+
+func guessContentType(filename string) string {
+	ext := strings.ToLower(path.Ext(filename))
+	if ext == "" {
+		return ""
+	}
+	if contentType, ok := contentTypeByExtension[ext]; ok {
+		return contentType
+	}
+	return mime.TypeByExtension(ext)
+}
+
+func isRFC5987AttrChar(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.IndexByte("!#$&+-.^_`|~", c) >= 0
+}
+
+// FormatContentDisposition builds a Content-Disposition value with a quoted
+// ascii filename, plus the RFC 5987 encoded filename* for non-ascii names.
+func FormatContentDisposition(disposition, filename string) string {
+	isASCII := true
+	fallback := strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f {
+			isASCII = false
+			return -1
+		}
+		if r > 0x7e {
+			isASCII = false
+			return '_'
+		}
+		return r
+	}, filename)
+	value := disposition + `; filename="` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(fallback) + `"`
+	if !isASCII {
+		var encoded strings.Builder
+		for i := 0; i < len(filename); i++ {
+			if c := filename[i]; isRFC5987AttrChar(c) {
+				encoded.WriteByte(c)
+			} else {
+				fmt.Fprintf(&encoded, "%%%02X", c)
+			}
+		}
+		value += "; filename*=UTF-8''" + encoded.String()
+	}
+	return value
+}
+
+// Applied to every proxied response, before the rules of the link itself.
+var ProxyResponseHeaders = func() *ResponseHeaderRules {
+	value := getEnv("STREMTHRU_PROXY_RESPONSE_HEADERS")
+	if value == "" {
+		return nil
+	}
+	rules := &ResponseHeaderRules{}
+	if err := json.Unmarshal([]byte(value), rules); err != nil {
+		log.Fatalf("malformed STREMTHRU_PROXY_RESPONSE_HEADERS: %v", err)
+	}
+	if err := rules.Validate(); err != nil {
+		log.Fatalf("invalid STREMTHRU_PROXY_RESPONSE_HEADERS: %v", err)
+	}
+	return rules
+}()
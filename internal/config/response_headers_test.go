@@ -0,0 +1,72 @@
+package config
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type ResponseHeaderRulesTestSuite struct {
+	suite.Suite
+}
+
+func (s *ResponseHeaderRulesTestSuite) TestMergeAndApply() {
+	base := &ResponseHeaderRules{
+		StripCookies: true,
+		Set:          map[string]string{"cache-control": "no-store", "X-Proxy": "stremthru"},
+	}
+	rules := &ResponseHeaderRules{
+		ContentType:        "video/mp4",
+		ContentDisposition: "inline",
+		Strip:              []string{"X-Upstream", "Content-Length"},
+		Set:                map[string]string{"Cache-Control": "private, max-age=60"},
+	}
+
+	header := http.Header{}
+	header.Set("Content-Type", "application/octet-stream")
+	header.Set("Content-Length", "42")
+	header.Set("Set-Cookie", "session=1")
+	header.Set("X-Upstream", "1")
+	header.Set("Server-Timing", "db;dur=1")
+
+	rules.Merge(base).Apply(header, "a.mp4")
+
+	s.Equal("video/mp4", header.Get("Content-Type"))
+	s.Equal("42", header.Get("Content-Length"))
+	s.Equal(`inline; filename="a.mp4"`, header.Get("Content-Disposition"))
+	s.Equal("private, max-age=60", header.Get("Cache-Control"))
+	s.Equal("stremthru", header.Get("X-Proxy"))
+	s.Equal("", header.Get("Set-Cookie"))
+	s.Equal("", header.Get("X-Upstream"))
+	s.Equal("db;dur=1", header.Get("Server-Timing"))
+}
+
+func (s *ResponseHeaderRulesTestSuite) TestValidate() {
+	s.Nil((&ResponseHeaderRules{ContentDisposition: "attachment"}).Validate())
+	s.NotNil((&ResponseHeaderRules{ContentDisposition: "download"}).Validate())
+	s.NotNil((&ResponseHeaderRules{Set: map[string]string{"Transfer-Encoding": "chunked"}}).Validate())
+	s.NotNil((&ResponseHeaderRules{Set: map[string]string{"X-A": "1\r\nX-B: 2"}}).Validate())
+}
+
+func (s *ResponseHeaderRulesTestSuite) TestFilename() {
+	header := http.Header{}
+	header.Set("Content-Type", "application/octet-stream")
+
+	var rules *ResponseHeaderRules
+	rules.Apply(header, "Amélie (2001).mkv")
+
+	s.Equal("video/x-matroska", header.Get("Content-Type"))
+	s.Equal(`inline; filename="Am_lie (2001).mkv"; filename*=UTF-8''Am%C3%A9lie%20%282001%29.mkv`, header.Get("Content-Disposition"))
+
+	header = http.Header{}
+	header.Set("Content-Type", "video/webm")
+	(&ResponseHeaderRules{ContentDisposition: "none"}).Apply(header, "a.mkv")
+
+	s.Equal("video/webm", header.Get("Content-Type"))
+	s.Equal("", header.Get("Content-Disposition"))
+}
+
+func TestResponseHeaderRules(t *testing.T) {
+	suite.Run(t, new(ResponseHeaderRulesTestSuite))
+}
@@ -0,0 +1,182 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var ErrSSRFBlocked = errors.New("upstream address not allowed")
+
+// Ranges not covered by the netip.Addr helpers.
+var ssrfBlockedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),     // "this" network
+	netip.MustParsePrefix("100.64.0.0/10"), // carrier-grade nat, also alibaba cloud metadata
+	netip.MustParsePrefix("192.0.0.0/24"),  // ietf protocol assignments, also oracle cloud metadata
+	netip.MustParsePrefix("198.18.0.0/15"), // benchmarking
+	netip.MustParsePrefix("240.0.0.0/4"),   // reserved, also broadcast
+	netip.MustParsePrefix("fec0::/10"),     // deprecated site-local
+}
+
+// SSRFGuard blocks upstream requests to private, loopback, link-local and
+// cloud metadata addresses, unless explicitly allowed.
+type SSRFGuard struct {
+	enabled      bool
+	allowedIPs   []netip.Prefix
+	allowedHosts map[string]struct{}
+}
+
+func (g *SSRFGuard) IsEnabled() bool {
+	return g.enabled
+}
+
+func (g *SSRFGuard) isAllowedHost(hostname string) bool {
+	hn := strings.ToLower(strings.TrimSuffix(hostname, "."))
+	for hn != "" {
+		if _, ok := g.allowedHosts[hn]; ok {
+			return true
+		}
+		_, hn, _ = strings.Cut(hn, ".")
+	}
+	return false
+}
+
+func (g *SSRFGuard) IsAllowedIP(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	for _, prefix := range g.allowedIPs {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return false
+	}
+	for _, prefix := range ssrfBlockedPrefixes {
+		if prefix.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// CheckURL resolves the url host and fails if any of its addresses is blocked.
+// Lookup failures are not reported here, the dialer guards the actual connection.
+func (g *SSRFGuard) CheckURL(ctx context.Context, u *url.URL) error {
+	hostname := u.Hostname()
+	if !g.enabled || g.isAllowedHost(hostname) {
+		return nil
+	}
+	if ip, err := netip.ParseAddr(hostname); err == nil {
+		if !g.IsAllowedIP(ip) {
+			return fmt.Errorf("%w: %s", ErrSSRFBlocked, hostname)
+		}
+		return nil
+	}
+	ips, err := net.DefaultResolver.LookupNetIP(ctx, "ip", hostname)
+	if err != nil {
+		return nil
+	}
+	for _, ip := range ips {
+		if !g.IsAllowedIP(ip) {
+			return fmt.Errorf("%w: %s resolves to %s", ErrSSRFBlocked, hostname, ip)
+		}
+	}
+	return nil
+}
+
+// tunnelProxyKey is the context key of the tunnel proxy address a request goes through
+type tunnelProxyKey struct{}
+
+// DialContext checks the address actually connected to, after dns
+// resolution, so a rebinding host can not slip past CheckURL. Only the dial
+// of a guarded transport to the tunnel proxy of its request is not checked.
+func (g *SSRFGuard) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	host, _, _ := net.SplitHostPort(addr)
+	isProxy := ctx.Value(tunnelProxyKey{}) == addr
+	if g.enabled && !isProxy && !g.isAllowedHost(host) {
+		dialer.Control = func(network, address string, c syscall.RawConn) error {
+			addrPort, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return err
+			}
+			if !g.IsAllowedIP(addrPort.Addr()) {
+				return fmt.Errorf("%w: %s resolves to %s", ErrSSRFBlocked, host, addrPort.Addr())
+			}
+			return nil
+		}
+	}
+	return dialer.DialContext(ctx, network, addr)
+}
+
+// guardedTransport passes the tunnel proxy of each request to the dialer
+type guardedTransport struct {
+	*http.Transport
+}
+
+func (t guardedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.Proxy != nil {
+		if proxyUrl, err := t.Proxy(req); err == nil && proxyUrl != nil {
+			req = req.WithContext(context.WithValue(req.Context(), tunnelProxyKey{}, tunnelProxyAddr(proxyUrl)))
+		}
+	}
+	return t.Transport.RoundTrip(req)
+}
+
+// Transport guards the dials of transport, which reaches its tunnel proxy
+// unchecked
+func (g *SSRFGuard) Transport(transport *http.Transport) http.RoundTripper {
+	transport.DialContext = g.DialContext
+	return guardedTransport{transport}
+}
+
+func tunnelProxyAddr(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		switch u.Scheme {
+		case "https":
+			port = "443"
+		case "socks5", "socks5h":
+			port = "1080"
+		default:
+			port = "80"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+func parseSSRFGuard(enabled bool, allow string) *SSRFGuard {
+	g := &SSRFGuard{
+		enabled:      enabled,
+		allowedIPs:   []netip.Prefix{},
+		allowedHosts: map[string]struct{}{},
+	}
+	for _, value := range strings.FieldsFunc(allow, func(c rune) bool {
+		return c == ','
+	}) {
+		value = strings.TrimSpace(value)
+		if prefix, err := netip.ParsePrefix(value); err == nil {
+			g.allowedIPs = append(g.allowedIPs, prefix.Masked())
+		} else if ip, err := netip.ParseAddr(value); err == nil {
+			g.allowedIPs = append(g.allowedIPs, netip.PrefixFrom(ip, ip.BitLen()))
+		} else {
+			g.allowedHosts[strings.ToLower(value)] = struct{}{}
+		}
+	}
+	return g
+}
+
+var SSRF = parseSSRFGuard(
+	strings.ToLower(getEnv("STREMTHRU_PROXY_SSRF_GUARD")) != "false",
+	getEnv("STREMTHRU_PROXY_SSRF_ALLOW"),
+)
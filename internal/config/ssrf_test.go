@@ -0,0 +1,89 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type SSRFGuardTestSuite struct {
+	suite.Suite
+}
+
+func (s *SSRFGuardTestSuite) TestBlockedIPs() {
+	g := parseSSRFGuard(true, "")
+
+	for _, ip := range []string{"127.0.0.1", "10.1.2.3", "172.16.0.1", "192.168.1.1", "169.254.169.254", "100.100.100.200", "0.0.0.0", "::1", "fe80::1", "fd00:ec2::254", "::ffff:127.0.0.1"} {
+		s.False(g.IsAllowedIP(netip.MustParseAddr(ip)), ip)
+	}
+	for _, ip := range []string{"1.1.1.1", "203.0.113.7", "2606:4700:4700::1111"} {
+		s.True(g.IsAllowedIP(netip.MustParseAddr(ip)), ip)
+	}
+}
+
+func (s *SSRFGuardTestSuite) TestAllowlist() {
+	g := parseSSRFGuard(true, "10.0.0.0/8,192.168.1.5,media.lan")
+
+	s.True(g.IsAllowedIP(netip.MustParseAddr("10.20.30.40")))
+	s.True(g.IsAllowedIP(netip.MustParseAddr("192.168.1.5")))
+	s.False(g.IsAllowedIP(netip.MustParseAddr("192.168.1.6")))
+
+	s.Nil(g.CheckURL(context.Background(), &url.URL{Scheme: "http", Host: "jellyfin.media.lan"}))
+	s.True(errors.Is(g.CheckURL(context.Background(), &url.URL{Scheme: "http", Host: "127.0.0.1:8080"}), ErrSSRFBlocked))
+}
+
+func (s *SSRFGuardTestSuite) TestDialContext() {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+
+	u, _ := url.Parse(upstream.URL)
+
+	g := parseSSRFGuard(true, "")
+	_, err := g.DialContext(context.Background(), "tcp", u.Host)
+	s.True(errors.Is(err, ErrSSRFBlocked))
+
+	g = parseSSRFGuard(false, "")
+	conn, err := g.DialContext(context.Background(), "tcp", net.JoinHostPort("127.0.0.1", u.Port()))
+	s.Nil(err)
+	conn.Close()
+}
+
+func (s *SSRFGuardTestSuite) TestTransport() {
+	// answers every request, like a forward proxy
+	tunnel := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.String()))
+	}))
+	defer tunnel.Close()
+	tunnelUrl, _ := url.Parse(tunnel.URL)
+
+	g := parseSSRFGuard(true, "")
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = func(req *http.Request) (*url.URL, error) {
+		if req.URL.Hostname() == "1.1.1.1" {
+			return tunnelUrl, nil
+		}
+		return nil, nil
+	}
+	client := &http.Client{Transport: g.Transport(transport)}
+
+	res, err := client.Get("http://1.1.1.1/video.mkv")
+	s.Require().NoError(err, "the tunnel proxy is dialed unchecked")
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	s.Equal("http://1.1.1.1/video.mkv", string(body))
+
+	_, err = client.Get(tunnel.URL + "/video.mkv")
+	s.True(errors.Is(err, ErrSSRFBlocked), "the tunnel proxy address is checked when not tunneled")
+}
+
+func TestSSRFGuard(t *testing.T) {
+	suite.Run(t, new(SSRFGuardTestSuite))
+}
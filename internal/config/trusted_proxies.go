@@ -0,0 +1,214 @@
+package config
+
+import (
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// TrustedProxies are the peers whose Forwarded and X-Forwarded-* headers are honoured
+type TrustedProxies []netip.Prefix
+
+func (tp TrustedProxies) isTrusted(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	for _, prefix := range tp {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ForwardedInfo is what trusted proxies report about the original request
+type ForwardedInfo struct {
+	For   string
+	Proto string
+	Host  string
+}
+
+func parseRemoteAddr(remoteAddr string) (netip.Addr, bool) {
+	if addrPort, err := netip.ParseAddrPort(remoteAddr); err == nil {
+		return addrPort.Addr().Unmap(), true
+	}
+	if ip, err := netip.ParseAddr(remoteAddr); err == nil {
+		return ip.Unmap(), true
+	}
+	return netip.Addr{}, false
+}
+
+// Forwarded node: ip, "ip:port", "[ipv6]:port", or an obfuscated identifier.
+func parseForwardedNode(node string) (netip.Addr, bool) {
+	node = strings.Trim(node, `"`)
+	if host, _, err := net.SplitHostPort(node); err == nil {
+		node = host
+	}
+	node = strings.TrimSuffix(strings.TrimPrefix(node, "["), "]")
+	ip, err := netip.ParseAddr(node)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return ip.Unmap(), true
+}
+
+// splitOutsideQuotes splits value on sep, ignoring separators in quoted strings
+func splitOutsideQuotes(value string, sep byte) []string {
+	parts := []string{}
+	inQuotes, escaped, start := false, false, 0
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; {
+		case escaped:
+			escaped = false
+		case c == '\\' && inQuotes:
+			escaped = true
+		case c == '"':
+			inQuotes = !inQuotes
+		case c == sep && !inQuotes:
+			parts = append(parts, value[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, value[start:])
+}
+
+// parseForwarded parses the RFC 7239 Forwarded header values into elements,
+// ordered from the farthest to the closest proxy.
+func parseForwarded(values []string) []map[string]string {
+	elements := []map[string]string{}
+	for _, value := range values {
+		for _, element := range splitOutsideQuotes(value, ',') {
+			pairs := map[string]string{}
+			for _, pair := range splitOutsideQuotes(element, ';') {
+				key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if !ok {
+					continue
+				}
+				if len(value) > 1 && strings.HasPrefix(value, `"`) && strings.HasSuffix(value, `"`) {
+					value = strings.ReplaceAll(value[1:len(value)-1], `\`, "")
+				}
+				pairs[strings.ToLower(key)] = value
+			}
+			elements = append(elements, pairs)
+		}
+	}
+	return elements
+}
+
+func splitHeaderList(values []string) []string {
+	list := []string{}
+	for _, value := range values {
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+	}
+	return list
+}
+
+// GetForwarded returns the forwarded information of r, or nil when its peer
+// is not trusted. The client is the closest address not itself trusted.
+func (tp TrustedProxies) GetForwarded(r *http.Request) *ForwardedInfo {
+	peer, ok := parseRemoteAddr(r.RemoteAddr)
+	if !ok || !tp.isTrusted(peer) {
+		return nil
+	}
+
+	info := &ForwardedInfo{For: peer.String()}
+
+	if values := r.Header.Values("Forwarded"); len(values) > 0 {
+		elements := parseForwarded(values)
+		for i := len(elements) - 1; i >= 0; i-- {
+			element := elements[i]
+			// elements without proto or host keep those of closer proxies
+			if proto := element["proto"]; proto != "" {
+				info.Proto = strings.ToLower(proto)
+			}
+			if host := element["host"]; host != "" {
+				info.Host = host
+			}
+			ip, ok := parseForwardedNode(element["for"])
+			if !ok {
+				break
+			}
+			info.For = ip.String()
+			if !tp.isTrusted(ip) {
+				break
+			}
+		}
+		return info
+	}
+
+	forwardedFor := splitHeaderList(r.Header.Values("X-Forwarded-For"))
+	hop := len(forwardedFor)
+	for i := len(forwardedFor) - 1; i >= 0; i-- {
+		ip, ok := parseForwardedNode(forwardedFor[i])
+		if !ok {
+			break
+		}
+		info.For, hop = ip.String(), i
+		if !tp.isTrusted(ip) {
+			break
+		}
+	}
+	// the proxy that appended the client address also appended the proto
+	// and host it received, entries farther left come from the client
+	hopsFromRight := max(len(forwardedFor)-hop, 1)
+	if proto := forwardedHopEntry(r.Header.Values("X-Forwarded-Proto"), hopsFromRight); proto != "" {
+		info.Proto = strings.ToLower(proto)
+	}
+	if host := forwardedHopEntry(r.Header.Values("X-Forwarded-Host"), hopsFromRight); host != "" {
+		info.Host = host
+	}
+	return info
+}
+
+// forwardedHopEntry returns the entry of a X-Forwarded-* list added by the
+// proxy hopsFromRight hops away, or the farthest one when closer proxies
+// overwrite the list instead of appending to it.
+func forwardedHopEntry(values []string, hopsFromRight int) string {
+	list := splitHeaderList(values)
+	if len(list) == 0 {
+		return ""
+	}
+	return list[max(len(list)-hopsFromRight, 0)]
+}
+
+// GetClientIP returns the real client ip of r, as reported by trusted proxies
+func (tp TrustedProxies) GetClientIP(r *http.Request) string {
+	if info := tp.GetForwarded(r); info != nil {
+		return info.For
+	}
+	if peer, ok := parseRemoteAddr(r.RemoteAddr); ok {
+		return peer.String()
+	}
+	return r.RemoteAddr
+}
+
+func parseTrustedProxies(value string) (TrustedProxies, error) {
+	tp := TrustedProxies{}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if prefix, err := netip.ParsePrefix(item); err == nil {
+			tp = append(tp, prefix.Masked())
+		} else if ip, err := netip.ParseAddr(item); err == nil {
+			tp = append(tp, netip.PrefixFrom(ip.Unmap(), ip.Unmap().BitLen()))
+		} else {
+			return nil, errors.New("invalid ip or cidr: " + item)
+		}
+	}
+	return tp, nil
+}
+
+var TrustedProxy = func() TrustedProxies {
+	tp, err := parseTrustedProxies(getEnv("STREMTHRU_TRUSTED_PROXIES"))
+	if err != nil {
+		log.Fatalf("invalid STREMTHRU_TRUSTED_PROXIES: %v", err)
+	}
+	return tp
+}()
@@ -0,0 +1,91 @@
+package config
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type TrustedProxiesTestSuite struct {
+	suite.Suite
+}
+
+func (s *TrustedProxiesTestSuite) parse(value string) TrustedProxies {
+	tp, err := parseTrustedProxies(value)
+	s.Require().NoError(err)
+	return tp
+}
+
+func (s *TrustedProxiesTestSuite) TestInvalid() {
+	_, err := parseTrustedProxies("10.0.0.0/8,not-an-ip")
+	s.Error(err)
+
+	_, err = parseTrustedProxies("10.0.0.0/33")
+	s.Error(err)
+}
+
+func (s *TrustedProxiesTestSuite) TestUntrustedPeer() {
+	tp := s.parse("10.0.0.0/8")
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "203.0.113.7:4321"
+	r.Header.Set("X-Forwarded-For", "1.1.1.1")
+	r.Header.Set("X-Forwarded-Host", "evil.example")
+
+	s.Nil(tp.GetForwarded(r))
+	s.Equal("203.0.113.7", tp.GetClientIP(r))
+}
+
+func (s *TrustedProxiesTestSuite) TestXForwarded() {
+	tp := s.parse("10.0.0.0/8,192.168.1.5")
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "10.0.0.2:4321"
+	r.Header.Set("X-Forwarded-For", "6.6.6.6, 203.0.113.7, 192.168.1.5")
+	r.Header.Set("X-Forwarded-Proto", "HTTPS")
+	r.Header.Set("X-Forwarded-Host", "proxy.example.com")
+
+	s.Equal(&ForwardedInfo{For: "203.0.113.7", Proto: "https", Host: "proxy.example.com"}, tp.GetForwarded(r))
+}
+
+func (s *TrustedProxiesTestSuite) TestForwarded() {
+	tp := s.parse("10.0.0.0/8")
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "10.0.0.2:4321"
+	r.Header.Add("Forwarded", `for="[2001:db8::1]:4711";proto=https;host="proxy.example.com"`)
+	r.Header.Add("Forwarded", "for=10.0.0.9;proto=http;host=internal")
+	r.Header.Set("X-Forwarded-Host", "ignored.example")
+
+	s.Equal(&ForwardedInfo{For: "2001:db8::1", Proto: "https", Host: "proxy.example.com"}, tp.GetForwarded(r))
+
+	r.Header.Set("Forwarded", "for=_hidden;proto=https, for=10.0.0.9")
+	s.Equal("10.0.0.9", tp.GetClientIP(r))
+}
+
+func (s *TrustedProxiesTestSuite) TestXForwardedSpoofed() {
+	tp := s.parse("10.0.0.0/8")
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "10.0.0.2:4321"
+	r.Header.Set("X-Forwarded-For", "1.1.1.1, 203.0.113.7")
+	r.Header.Set("X-Forwarded-Proto", "http, https")
+	r.Header.Set("X-Forwarded-Host", "evil.example, proxy.example.com")
+
+	s.Equal(&ForwardedInfo{For: "203.0.113.7", Proto: "https", Host: "proxy.example.com"}, tp.GetForwarded(r), "entries added by the client are ignored")
+}
+
+func (s *TrustedProxiesTestSuite) TestForwardedPartialElement() {
+	tp := s.parse("10.0.0.0/8")
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "10.0.0.2:4321"
+	r.Header.Set("Forwarded", "for=203.0.113.7, for=10.0.0.9;proto=https;host=proxy.example.com")
+
+	s.Equal(&ForwardedInfo{For: "203.0.113.7", Proto: "https", Host: "proxy.example.com"}, tp.GetForwarded(r))
+}
+
+func TestTrustedProxies(t *testing.T) {
+	suite.Run(t, new(TrustedProxiesTestSuite))
+}
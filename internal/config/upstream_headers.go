@@ -0,0 +1,74 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// UpstreamHeaderRules describes headers added to requests sent to an upstream host
+type UpstreamHeaderRules struct {
+	Via       bool              `json:"via,omitempty"`
+	Forwarded bool              `json:"forwarded,omitempty"`
+	Set       map[string]string `json:"set,omitempty"`
+}
+
+func (rules *UpstreamHeaderRules) Validate() error {
+	for key, value := range rules.Set {
+		key = http.CanonicalHeaderKey(key)
+		if key == "" || strings.ContainsAny(key, " :\r\n") {
+			return errors.New("invalid header: " + key)
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			return errors.New("invalid header value")
+		}
+	}
+	return nil
+}
+
+// UpstreamHeaderMap holds the rules by hostname, "*" being the default.
+type UpstreamHeaderMap map[string]*UpstreamHeaderRules
+
+// Get returns the rules for hostname, or for its closest configured parent
+// domain, or the default rules.
+func (uhm UpstreamHeaderMap) Get(hostname string) *UpstreamHeaderRules {
+	hn := strings.ToLower(strings.TrimSuffix(hostname, "."))
+	for hn != "" {
+		if rules, ok := uhm[hn]; ok {
+			return rules
+		}
+		_, hn, _ = strings.Cut(hn, ".")
+	}
+	return uhm["*"]
+}
+
+func parseUpstreamHeaders(value string) (UpstreamHeaderMap, error) {
+	uhm := UpstreamHeaderMap{}
+	if value == "" {
+		return uhm, nil
+	}
+	rulesByHost := map[string]*UpstreamHeaderRules{}
+	if err := json.Unmarshal([]byte(value), &rulesByHost); err != nil {
+		return nil, err
+	}
+	for hostname, rules := range rulesByHost {
+		if rules == nil {
+			continue
+		}
+		if err := rules.Validate(); err != nil {
+			return nil, errors.New(hostname + ": " + err.Error())
+		}
+		uhm[strings.ToLower(hostname)] = rules
+	}
+	return uhm, nil
+}
+
+var ProxyUpstreamHeaders = func() UpstreamHeaderMap {
+	uhm, err := parseUpstreamHeaders(getEnv("STREMTHRU_PROXY_UPSTREAM_HEADERS"))
+	if err != nil {
+		log.Fatalf("invalid STREMTHRU_PROXY_UPSTREAM_HEADERS: %v", err)
+	}
+	return uhm
+}()
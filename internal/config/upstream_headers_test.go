@@ -0,0 +1,37 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type UpstreamHeadersTestSuite struct {
+	suite.Suite
+}
+
+func (s *UpstreamHeadersTestSuite) TestGet() {
+	uhm, err := parseUpstreamHeaders(`{"*":{"via":true},"Example.com":{"forwarded":true,"set":{"X-Proxy-Secret":"s3cr3t"}}}`)
+	s.Require().NoError(err)
+
+	s.True(uhm.Get("cdn.example.com").Forwarded)
+	s.Equal("s3cr3t", uhm.Get("example.com").Set["X-Proxy-Secret"])
+	s.True(uhm.Get("other.org").Via)
+	s.False(uhm.Get("other.org").Forwarded)
+
+	uhm, err = parseUpstreamHeaders("")
+	s.Require().NoError(err)
+	s.Nil(uhm.Get("example.com"))
+}
+
+func (s *UpstreamHeadersTestSuite) TestInvalid() {
+	_, err := parseUpstreamHeaders(`{"example.com":{"set":{"X-Bad":"a\r\nb"}}}`)
+	s.Error(err)
+
+	_, err = parseUpstreamHeaders(`{"example.com":true}`)
+	s.Error(err)
+}
+
+func TestUpstreamHeaders(t *testing.T) {
+	suite.Run(t, new(UpstreamHeadersTestSuite))
+}
@@ -0,0 +1,20 @@
+package endpoint
+
+import (
+	"os"
+	"testing"
+
+	"github.com/Dydhzo/stremthru-proxy/internal/config"
+)
+
+// Links created by the tests are recorded, every suite shares a temporary store.
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "stremthru-test-")
+	if err != nil {
+		panic(err)
+	}
+	config.DataDir = dir
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
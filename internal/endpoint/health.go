@@ -28,9 +28,14 @@ type HealthDebugUserData struct {
 
 // HealthDebugIPData represents client IP information
 type HealthDebugIPData struct {
-	Machine  string            `json:"machine"`
-	Tunnel   map[string]string `json:"tunnel"`
-	Exposed  map[string]string `json:"exposed"`
+	Machine    string            `json:"machine"`
+	Tunnel     map[string]string `json:"tunnel"`
+	Exposed    map[string]string `json:"exposed"`
+	Checker    string            `json:"checker,omitempty"`
+	CheckedAt  string            `json:"checked_at,omitempty"`
+	StaleAt    string            `json:"stale_at,omitempty"`
+	Refreshing bool              `json:"refreshing"`
+	Errors     []string          `json:"errors,omitempty"`
 }
 
 // handleHealth provides basic health check endpoint
@@ -61,16 +66,35 @@ func handleHealthDebug(w http.ResponseWriter, r *http.Request) {
 			Name: user,
 		}
 
-		// Get Machine IP like original (only when authorized)
-		machineIP := config.IP.GetMachineIP()
+		// Get Machine IP like original (only when authorized), resolution
+		// failures are reported in the errors instead of failing the request
+		machineIP, _ := config.IP.GetMachineIP()
 
-		// Simple IP structure for clean proxy (like original logic)
 		debug.IP = &HealthDebugIPData{
 			Machine: machineIP,
-			Tunnel:  map[string]string{}, // Empty for clean proxy
-			Exposed: map[string]string{
-				"*": machineIP, // Same as original logic
-			},
+			Tunnel:  map[string]string{},
+			Exposed: map[string]string{},
+		}
+
+		// Tunnel egress IP per proxy host, and the IP each hostname rule exposes upstream
+		tunnelIpByProxyHost, _ := config.IP.GetTunnelIPByProxyHost()
+		for proxyHost, ip := range tunnelIpByProxyHost {
+			debug.IP.Tunnel[proxyHost] = ip
+		}
+		exposedIpByHostname, _ := config.IP.GetTunnelIPByHostname()
+		for hostname, ip := range exposedIpByHostname {
+			debug.IP.Exposed[hostname] = ip
+		}
+
+		status := config.IP.GetStatus()
+		debug.IP.Checker = status.Checker
+		if !status.CheckedAt.IsZero() {
+			debug.IP.CheckedAt = status.CheckedAt.Format(time.RFC3339)
+			debug.IP.StaleAt = status.StaleAt.Format(time.RFC3339)
+		}
+		debug.IP.Refreshing = status.Refreshing
+		for _, err := range status.Errors {
+			debug.IP.Errors = append(debug.IP.Errors, err.Error())
 		}
 	}
 
@@ -81,5 +105,5 @@ func handleHealthDebug(w http.ResponseWriter, r *http.Request) {
 // AddHealthEndpoints registers health check HTTP endpoints
 func AddHealthEndpoints(mux *http.ServeMux) {
 	mux.HandleFunc("/v0/health", handleHealth)
-	mux.HandleFunc("/v0/health/__debug__", handleHealthDebug)
+	mux.HandleFunc("/v0/health/__debug__", shared.GuardClient(handleHealthDebug))
 }
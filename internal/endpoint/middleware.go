@@ -8,6 +8,7 @@ import (
 	"github.com/Dydhzo/stremthru-proxy/internal/config"
 	"github.com/Dydhzo/stremthru-proxy/internal/context"
 	"github.com/Dydhzo/stremthru-proxy/internal/server"
+	"github.com/Dydhzo/stremthru-proxy/internal/shared"
 )
 
 func extractProxyAuthToken(r *http.Request, readQuery bool) (token string, hasToken bool) {
@@ -31,9 +32,27 @@ func getProxyAuthorization(r *http.Request, readQuery bool) (isAuthorized bool,
 	isAuthorized = hasToken && err == nil && config.ProxyAuth.IsAuthorized(auth.Username, auth.Password)
 	user = auth.Username
 	pass = auth.Password
+	if isAuthorized {
+		server.GetReqCtx(r).User = user
+	} else if hasToken {
+		shared.RecordClientFailure(r, "invalid credentials")
+	}
 	return isAuthorized, user, pass
 }
 
+// requireProxyAuthorization sends a forbidden error unless the request
+// carries valid credentials, which are then redacted from the logged url.
+func requireProxyAuthorization(w http.ResponseWriter, r *http.Request) (user string, ok bool) {
+	isAuthorized, user, _ := getProxyAuthorization(r, true)
+	if !isAuthorized {
+		w.Header().Add(server.HEADER_STREMTHRU_AUTHENTICATE, "Basic")
+		shared.ErrorForbidden(r).Send(w, r)
+		return "", false
+	}
+	server.GetReqCtx(r).RedactURLQueryParams(r, "token")
+	return user, true
+}
+
 func ProxyAuthContext(next http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		ctx := context.GetProxyContext(r)
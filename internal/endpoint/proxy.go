@@ -1,14 +1,20 @@
 package endpoint
 
 import (
+	"encoding/json"
+	"errors"
+	"mime"
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/Dydhzo/stremthru-proxy/core"
 	"github.com/Dydhzo/stremthru-proxy/internal/config"
 	"github.com/Dydhzo/stremthru-proxy/internal/server"
 	"github.com/Dydhzo/stremthru-proxy/internal/shared"
+	"github.com/Dydhzo/stremthru-proxy/internal/tracing"
 )
 
 // handleProxyLinkAccess serves proxied content via JWT tokens
@@ -16,38 +22,275 @@ func handleProxyLinkAccess(w http.ResponseWriter, r *http.Request) {
 	ctx := server.GetReqCtx(r)
 	ctx.RedactURLPathValues(r, "token")
 
-	isGetReq := shared.IsMethod(r, http.MethodGet)
-	if !isGetReq && !shared.IsMethod(r, http.MethodHead) {
-		shared.ErrorMethodNotAllowed(r).Send(w, r)
-		return
-	}
-
 	encodedToken := r.PathValue("token")
 	if encodedToken == "" {
 		shared.ErrorBadRequest(r, "missing token").Send(w, r)
 		return
 	}
 
-	user, link, headers, tunnelType, err := shared.UnwrapProxyLinkToken(encodedToken)
+	_, span := tracing.Start(r.Context(), "proxy.unwrap_token")
+	link, err := shared.UnwrapProxyLinkToken(encodedToken)
+	tracing.End(span, err)
 	if err != nil {
+		if shared.IsInvalidProxyLinkTokenError(err) {
+			shared.RecordClientFailure(r, "invalid token")
+		}
 		shared.SendError(w, r, err)
+		shared.AuditProxyLinkAccess(w, r, nil, 0)
 		return
 	}
 
-	if headers != nil {
-		for k, v := range headers {
-			r.Header.Set(k, v)
+	serveProxyLink(w, r, link)
+}
+
+// serveProxyLink proxies the upstream of link, if it allows the request method
+func serveProxyLink(w http.ResponseWriter, r *http.Request, link *shared.ProxyLink) {
+	ctx := server.GetReqCtx(r)
+	ctx.User = link.User
+
+	if !link.AllowsMethod(r.Method) {
+		w.Header().Set("Allow", strings.Join(append([]string{http.MethodGet, http.MethodHead}, link.Methods...), ", "))
+		shared.ErrorMethodNotAllowed(r).Send(w, r)
+		shared.AuditProxyLinkAccess(w, r, link, 0)
+		return
+	}
+
+	use, err := shared.CheckProxyLinkAccess(r, link)
+	if err != nil {
+		shared.SendError(w, r, err)
+		shared.AuditProxyLinkAccess(w, r, link, 0)
+		return
+	}
+
+	bytesWritten, err := shared.ProxyResponse(w, r, link)
+	ctx.Log.Info("[proxy] connection closed", "user", link.User, "bytes", bytesWritten, "error", err)
+	use.Finish(w)
+	shared.RecordShortProxyLinkHit(w, r, link)
+	shared.RecordProxyLinkAccess(link.ID, bytesWritten)
+	shared.AuditProxyLinkAccess(w, r, link, bytesWritten)
+}
+
+// proxyLinkMetadata represents what a proxy link token carries, without the upstream url
+type proxyLinkMetadata struct {
+	TokenID         string   `json:"token_id,omitempty"`
+	ExpiresAt       string   `json:"expires_at,omitempty"`
+	Tunnel          string   `json:"tunnel"`
+	Encrypted       bool     `json:"encrypted"`
+	Filename        string   `json:"filename,omitempty"`
+	Methods         []string `json:"methods,omitempty"`
+	NotBefore       string   `json:"not_before,omitempty"`
+	MaxUses         int      `json:"max_uses,omitempty"`
+	MaxIPs          int      `json:"max_ips,omitempty"`
+	AllowedIPs      []string `json:"allowed_ips,omitempty"`
+	AllowedReferers []string `json:"allowed_referers,omitempty"`
+}
+
+func newProxyLinkMetadata(link *shared.ProxyLink, filename string) *proxyLinkMetadata {
+	metadata := &proxyLinkMetadata{
+		TokenID:   link.ID,
+		Tunnel:    link.TunnelType.Name(),
+		Encrypted: link.Encrypted,
+		Filename:  filename,
+		Methods:   link.Methods,
+	}
+	if !link.ExpiresAt.IsZero() {
+		metadata.ExpiresAt = link.ExpiresAt.UTC().Format(time.RFC3339)
+	}
+	if c := link.Constraints; c != nil {
+		if !c.NotBefore.IsZero() {
+			metadata.NotBefore = c.NotBefore.UTC().Format(time.RFC3339)
+		}
+		metadata.MaxUses = c.MaxUses
+		metadata.MaxIPs = c.MaxIPs
+		for _, prefix := range c.AllowedIPs {
+			metadata.AllowedIPs = append(metadata.AllowedIPs, prefix.String())
 		}
+		metadata.AllowedReferers = c.AllowedReferers
 	}
+	return metadata
+}
 
-	bytesWritten, err := shared.ProxyResponse(w, r, link, tunnelType)
-	ctx.Log.Info("[proxy] connection closed", "user", user, "bytes", bytesWritten, "error", err)
+// proxifyLinkResult represents the outcome for a single url of a link creation request
+type proxifyLinkResult struct {
+	URL   string      `json:"url,omitempty"`
+	Error *core.Error `json:"error,omitempty"`
+	*proxyLinkMetadata
+	StatusCode    int    `json:"status_code,omitempty"`
+	ContentType   string `json:"content_type,omitempty"`
+	ContentLength int64  `json:"content_length,omitempty"`
+	ProbeError    string `json:"probe_error,omitempty"`
 }
 
-// proxifyLinksData represents response for proxy link creation
+// proxifyLinksData represents response for proxy link creation, items is
+// empty for urls that failed, details are in results
 type proxifyLinksData struct {
-	Items      []string `json:"items"`
-	TotalItems int      `json:"total_items"`
+	Items      []string             `json:"items"`
+	Results    []*proxifyLinkResult `json:"results"`
+	TotalItems int                  `json:"total_items"`
+}
+
+// proxifyLinkInput is a single link to create, parsed from either request format
+type proxifyLinkInput struct {
+	link      *shared.ProxyLink
+	filename  string
+	expiresIn time.Duration
+	probe     bool
+	short     bool
+	// failed to parse, reported in the result of the item
+	err error
+}
+
+// maxConcurrentProbes bounds the HEAD requests sent for a single batch
+const maxConcurrentProbes = 4
+
+func probeProxifyLinkResults(r *http.Request, results []*proxifyLinkResult, inputs []proxifyLinkInput) {
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, maxConcurrentProbes)
+	for i, result := range results {
+		input := inputs[i]
+		if result.Error != nil || !input.probe {
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			probe, err := shared.ProbeUpstream(r.Context(), input.link.URL, input.link.Headers, input.link.TunnelType)
+			if err != nil {
+				result.ProbeError = err.Error()
+				return
+			}
+			result.StatusCode = probe.StatusCode
+			result.ContentType = probe.ContentType
+			if probe.ContentLength > 0 {
+				result.ContentLength = probe.ContentLength
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func createProxifyLinks(r *http.Request, inputs []proxifyLinkInput, user, password string) proxifyLinksData {
+	count := len(inputs)
+	proxyLinks := make([]string, count)
+	results := make([]*proxifyLinkResult, count)
+	for i, input := range inputs {
+		if input.err != nil {
+			results[i] = &proxifyLinkResult{Error: shared.PackError(r, input.err)}
+			continue
+		}
+		input.link.User = user
+		createProxyLink := shared.CreateProxyLink
+		if input.short {
+			createProxyLink = shared.CreateShortProxyLink
+		}
+		proxyURL, err := createProxyLink(r, input.link, input.expiresIn, password, input.filename)
+		if err != nil {
+			results[i] = &proxifyLinkResult{Error: shared.PackError(r, err)}
+			continue
+		}
+		shared.RecordProxyLink(input.link, input.filename, input.short)
+		shared.AuditProxyLinkCreated(r, input.link, input.short)
+		proxyLinks[i] = proxyURL
+		results[i] = &proxifyLinkResult{
+			URL:               proxyURL,
+			proxyLinkMetadata: newProxyLinkMetadata(input.link, input.filename),
+		}
+	}
+
+	probeProxifyLinkResults(r, results, inputs)
+
+	return proxifyLinksData{
+		Items:      proxyLinks,
+		Results:    results,
+		TotalItems: count,
+	}
+}
+
+func parseExpiresIn(exp string) (time.Duration, error) {
+	if exp == "" {
+		return 0, nil
+	}
+	if c := rune(exp[len(exp)-1]); '0' <= c && c <= '9' {
+		exp += "s"
+	}
+	expiresIn, err := time.ParseDuration(exp)
+	if err != nil || expiresIn < 0 {
+		return 0, errors.New("invalid expiration")
+	}
+	return expiresIn, nil
+}
+
+// parseNotBefore parses an RFC 3339 time, or a duration from now like "exp"
+func parseNotBefore(nbf string) (time.Time, error) {
+	if nbf == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, nbf); err == nil {
+		return t, nil
+	}
+	delay, err := parseExpiresIn(nbf)
+	if err != nil {
+		return time.Time{}, errors.New("invalid not before")
+	}
+	return time.Now().Add(delay).Truncate(time.Second), nil
+}
+
+// proxifyLinkConstraints are the link constraints of a creation request,
+// in either format
+type proxifyLinkConstraints struct {
+	NotBefore       string   `json:"nbf,omitempty"`
+	MaxUses         int      `json:"max_uses,omitempty"`
+	MaxIPs          int      `json:"max_ips,omitempty"`
+	AllowedIPs      []string `json:"allowed_ips,omitempty"`
+	BindIP          bool     `json:"bind_ip,omitempty"`
+	AllowedReferers []string `json:"allowed_referers,omitempty"`
+}
+
+func (input *proxifyLinkConstraints) parse(r *http.Request) (*shared.ProxyLinkConstraints, error) {
+	c := &shared.ProxyLinkConstraints{MaxUses: input.MaxUses, MaxIPs: input.MaxIPs}
+	nbf, err := parseNotBefore(input.NotBefore)
+	if err != nil {
+		return nil, err
+	}
+	c.NotBefore = nbf
+	if c.AllowedIPs, err = shared.ParseAllowedIPs(input.AllowedIPs); err != nil {
+		return nil, err
+	}
+	if input.BindIP {
+		if err := c.BindClientIP(r); err != nil {
+			return nil, err
+		}
+	}
+	if c.AllowedReferers, err = shared.ParseAllowedReferers(input.AllowedReferers); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func parseFormLinkConstraints(r *http.Request) (*shared.ProxyLinkConstraints, error) {
+	input := &proxifyLinkConstraints{
+		NotBefore:       r.Form.Get("nbf"),
+		AllowedIPs:      r.Form["allowed_ips"],
+		BindIP:          r.Form.Get("bind_ip") != "",
+		AllowedReferers: r.Form["allowed_referers"],
+	}
+	for name, value := range map[string]*int{"max_uses": &input.MaxUses, "max_ips": &input.MaxIPs} {
+		if v := r.Form.Get(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return nil, errors.New("invalid " + name)
+			}
+			*value = n
+		}
+	}
+	return input.parse(r)
+}
+
+func isJSONRequest(r *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mediaType == "application/json"
 }
 
 // handleProxifyLinks creates new proxy links with authentication
@@ -67,6 +310,16 @@ func handleProxifyLinks(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	shouldEncrypt := r.URL.Query().Get("token") == ""
+	if !shouldEncrypt {
+		ctx.RedactURLQueryParams(r, "token")
+	}
+
+	if !isGetReq && isJSONRequest(r) {
+		handleProxifyLinksJSON(w, r, user, password, shouldEncrypt)
+		return
+	}
+
 	err := r.ParseForm()
 	if err != nil {
 		shared.ErrorBadRequest(r, "failed to parse data").Send(w, r)
@@ -95,25 +348,36 @@ func handleProxifyLinks(w http.ResponseWriter, r *http.Request) {
 	reqHeadersByBlob := map[string]map[string]string{}
 	fallbackReqHeaders := r.Form.Get("req_headers")
 
-	expiresIn := 0 * time.Second
-	if exp := r.Form.Get("exp"); exp != "" {
-		if c := rune(exp[len(exp)-1]); '0' <= c && c <= '9' {
-			exp += "s"
-		}
-		exp, err := time.ParseDuration(exp)
-		if err != nil {
-			shared.ErrorBadRequest(r, "invalid expiration").Send(w, r)
-			return
-		}
-		expiresIn = exp
+	expiresIn, err := parseExpiresIn(r.Form.Get("exp"))
+	if err != nil {
+		shared.ErrorBadRequest(r, err.Error()).Send(w, r)
+		return
 	}
 
-	shouldEncrypt := r.URL.Query().Get("token") == ""
-	if !shouldEncrypt {
-		ctx.RedactURLQueryParams(r, "token")
+	shouldProbe := r.Form.Get("probe") != ""
+	isShort := r.Form.Get("short") != ""
+
+	var methods []string
+	for _, value := range r.Form["methods"] {
+		methods = append(methods, strings.Split(value, ",")...)
 	}
 
-	proxyLinks := make([]string, count)
+	constraints, err := parseFormLinkConstraints(r)
+	if err != nil {
+		shared.ErrorBadRequest(r, err.Error()).Send(w, r)
+		return
+	}
+
+	var responseHeaders *config.ResponseHeaderRules
+	if blob := r.Form.Get("resp_headers"); blob != "" {
+		responseHeaders = &config.ResponseHeaderRules{}
+		if err := json.Unmarshal([]byte(blob), responseHeaders); err != nil {
+			shared.ErrorBadRequest(r, "invalid resp_headers").Send(w, r)
+			return
+		}
+	}
+
+	inputs := make([]proxifyLinkInput, count)
 	for i, link := range links {
 		idx := strconv.Itoa(i)
 		var reqHeaders map[string]string
@@ -132,33 +396,184 @@ func handleProxifyLinks(w http.ResponseWriter, r *http.Request) {
 			}
 			reqHeadersByBlob[reqHeadersBlob] = reqHeaders
 		}
-		filename := r.Form.Get("filename[" + idx + "]")
-		proxyLink, err := shared.CreateProxyLink(r, link, reqHeaders, config.TUNNEL_TYPE_AUTO, expiresIn, user, password, shouldEncrypt, filename)
-		if err != nil {
+		inputs[i] = proxifyLinkInput{
+			link: &shared.ProxyLink{
+				URL:             link,
+				Headers:         reqHeaders,
+				TunnelType:      config.TUNNEL_TYPE_AUTO,
+				Encrypted:       shouldEncrypt,
+				ResponseHeaders: responseHeaders,
+				Methods:         methods,
+				Constraints:     constraints,
+			},
+			filename:  r.Form.Get("filename[" + idx + "]"),
+			expiresIn: expiresIn,
+			probe:     shouldProbe && !shouldRedirect,
+			short:     isShort,
+		}
+	}
+
+	data := createProxifyLinks(r, inputs, user, password)
+
+	if shouldRedirect {
+		if err := data.Results[0].Error; err != nil {
 			shared.SendError(w, r, err)
 			return
 		}
-		proxyLinks[i] = proxyLink
+		http.Redirect(w, r, data.Items[0], http.StatusFound)
+		return
 	}
 
-	if shouldRedirect {
-		http.Redirect(w, r, proxyLinks[0], http.StatusFound)
+	shared.SendResponse(w, r, 200, data, nil)
+}
+
+// proxifyLinkExpiry accepts seconds as a number, or a duration string like the form "exp"
+type proxifyLinkExpiry time.Duration
+
+func (e *proxifyLinkExpiry) UnmarshalJSON(data []byte) error {
+	var seconds int64
+	if err := json.Unmarshal(data, &seconds); err == nil {
+		if seconds < 0 {
+			return errors.New("invalid expiration")
+		}
+		*e = proxifyLinkExpiry(time.Duration(seconds) * time.Second)
+		return nil
+	}
+	var exp string
+	if err := json.Unmarshal(data, &exp); err != nil {
+		return errors.New("invalid expiration")
+	}
+	expiresIn, err := parseExpiresIn(exp)
+	if err != nil {
+		return err
+	}
+	*e = proxifyLinkExpiry(expiresIn)
+	return nil
+}
+
+// proxifyLinkItemOptions represents per-item options of the JSON link creation request
+type proxifyLinkItemOptions struct {
+	Encrypt *bool `json:"encrypt,omitempty"`
+	Probe   bool  `json:"probe,omitempty"`
+	Short   bool  `json:"short,omitempty"`
+}
+
+// proxifyLinkItem represents an item of the JSON link creation request
+type proxifyLinkItem struct {
+	URL             string                      `json:"url"`
+	Headers         map[string]string           `json:"headers,omitempty"`
+	ResponseHeaders *config.ResponseHeaderRules `json:"response_headers,omitempty"`
+	Filename        string                      `json:"filename,omitempty"`
+	Exp             proxifyLinkExpiry           `json:"exp,omitempty"`
+	Tunnel          string                      `json:"tunnel,omitempty"`
+	Methods         []string                    `json:"methods,omitempty"`
+	proxifyLinkConstraints
+	Options proxifyLinkItemOptions `json:"options"`
+}
+
+// maxProxifyLinksBodySize bounds the JSON link creation request body
+const maxProxifyLinksBodySize = 1 << 20
+
+// handleProxifyLinksJSON creates proxy links from a JSON array of items
+func handleProxifyLinksJSON(w http.ResponseWriter, r *http.Request, user, password string, shouldEncrypt bool) {
+	items := []proxifyLinkItem{}
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxProxifyLinksBodySize))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&items); err != nil {
+		shared.ErrorBadRequest(r, "failed to parse data: "+err.Error()).Send(w, r)
+		return
+	}
+	if len(items) == 0 {
+		shared.ErrorBadRequest(r, "missing url").Send(w, r)
 		return
 	}
 
-	data := proxifyLinksData{
-		Items:      proxyLinks,
-		TotalItems: count,
+	inputs := make([]proxifyLinkInput, len(items))
+	for i, item := range items {
+		tunnelType := config.TUNNEL_TYPE_AUTO
+		if item.Tunnel != "" {
+			tt, err := config.ParseTunnelType(item.Tunnel)
+			if err != nil {
+				inputs[i].err = shared.ErrorBadRequest(r, err.Error())
+				continue
+			}
+			tunnelType = tt
+		}
+		constraints, err := item.proxifyLinkConstraints.parse(r)
+		if err != nil {
+			inputs[i].err = shared.ErrorBadRequest(r, err.Error())
+			continue
+		}
+		encrypt := shouldEncrypt
+		if item.Options.Encrypt != nil {
+			encrypt = *item.Options.Encrypt
+		}
+		inputs[i] = proxifyLinkInput{
+			link: &shared.ProxyLink{
+				URL:             item.URL,
+				Headers:         item.Headers,
+				TunnelType:      tunnelType,
+				Encrypted:       encrypt,
+				ResponseHeaders: item.ResponseHeaders,
+				Methods:         item.Methods,
+				Constraints:     constraints,
+			},
+			filename:  item.Filename,
+			expiresIn: time.Duration(item.Exp),
+			probe:     item.Options.Probe,
+			short:     item.Options.Short,
+		}
 	}
 
-	shared.SendResponse(w, r, 200, data, nil)
+	shared.SendResponse(w, r, 200, createProxifyLinks(r, inputs, user, password), nil)
+}
+
+// handleProxyLinkInfo returns the metadata of a proxy link owned by the caller, without streaming it
+func handleProxyLinkInfo(w http.ResponseWriter, r *http.Request) {
+	ctx := server.GetReqCtx(r)
+	ctx.RedactURLPathValues(r, "token")
+
+	if !shared.IsMethod(r, http.MethodGet) {
+		shared.ErrorMethodNotAllowed(r).Send(w, r)
+		return
+	}
+
+	isAuthorized, user, _ := getProxyAuthorization(r, true)
+	if !isAuthorized {
+		w.Header().Add(server.HEADER_STREMTHRU_AUTHENTICATE, "Basic")
+		shared.ErrorForbidden(r).Send(w, r)
+		return
+	}
+	ctx.RedactURLQueryParams(r, "token")
+
+	link, err := shared.UnwrapProxyLinkToken(r.PathValue("token"))
+	if err != nil {
+		shared.SendError(w, r, err)
+		return
+	}
+	if link.User != user {
+		shared.ErrorForbidden(r).Send(w, r)
+		return
+	}
+
+	shared.SendResponse(w, r, 200, newProxyLinkMetadata(link, ""), nil)
 }
 
 // AddProxyEndpoints registers proxy-related HTTP endpoints
 func AddProxyEndpoints(mux *http.ServeMux) {
-	withCors := shared.Middleware(shared.EnableCORS)
+	withCors := shared.Middleware(shared.EnableCORS, shared.GuardClient)
 
 	mux.HandleFunc("/v0/proxy", withCors(handleProxifyLinks))
+	mux.HandleFunc("/v0/proxy/links", withCors(handleProxyLinks))
+	mux.HandleFunc("/v0/proxy/links/{id}", withCors(handleProxyLinkRecord))
 	mux.HandleFunc("/v0/proxy/{token}", withCors(handleProxyLinkAccess))
-	mux.HandleFunc("/v0/proxy/{token}/{filename}", withCors(handleProxyLinkAccess))
+	// "/v0/proxy/{token}/info" would conflict with "/v0/proxy/links/{id}" on
+	// "/v0/proxy/links/info", so the reserved filename is dispatched here.
+	mux.HandleFunc("/v0/proxy/{token}/{filename}", withCors(func(w http.ResponseWriter, r *http.Request) {
+		if r.PathValue("filename") == shared.ProxyLinkInfoFilename {
+			handleProxyLinkInfo(w, r)
+			return
+		}
+		handleProxyLinkAccess(w, r)
+	}))
 }
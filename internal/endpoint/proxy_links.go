@@ -0,0 +1,122 @@
+package endpoint
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/Dydhzo/stremthru-proxy/internal/config"
+	"github.com/Dydhzo/stremthru-proxy/internal/server"
+	"github.com/Dydhzo/stremthru-proxy/internal/shared"
+)
+
+// proxyLinkRecordInfo represents a created proxy link and its usage
+type proxyLinkRecordInfo struct {
+	ID           string `json:"id"`
+	User         string `json:"user"`
+	Host         string `json:"host"`
+	Filename     string `json:"filename,omitempty"`
+	Short        bool   `json:"short"`
+	CreatedAt    string `json:"created_at"`
+	ExpiresAt    string `json:"expires_at,omitempty"`
+	LastAccessAt string `json:"last_access_at,omitempty"`
+	BytesServed  int64  `json:"bytes_served"`
+}
+
+func newProxyLinkRecordInfo(plr *shared.ProxyLinkRecord) *proxyLinkRecordInfo {
+	info := &proxyLinkRecordInfo{
+		ID:          plr.ID,
+		User:        plr.User,
+		Host:        plr.Host,
+		Filename:    plr.Filename,
+		Short:       plr.Short,
+		CreatedAt:   plr.CreatedAt.UTC().Format(time.RFC3339),
+		BytesServed: plr.BytesServed,
+	}
+	if !plr.ExpiresAt.IsZero() {
+		info.ExpiresAt = plr.ExpiresAt.UTC().Format(time.RFC3339)
+	}
+	if !plr.LastAccessAt.IsZero() {
+		info.LastAccessAt = plr.LastAccessAt.UTC().Format(time.RFC3339)
+	}
+	return info
+}
+
+// proxyLinkRecordsData represents response for proxy link listing
+type proxyLinkRecordsData struct {
+	Items      []*proxyLinkRecordInfo `json:"items"`
+	TotalItems int                    `json:"total_items"`
+}
+
+// handleProxyLinks lists the links created by the authenticated user. Admins
+// can list those of another user with "user", or of every user with "user=*".
+func handleProxyLinks(w http.ResponseWriter, r *http.Request) {
+	if !shared.IsMethod(r, http.MethodGet) {
+		shared.ErrorMethodNotAllowed(r).Send(w, r)
+		return
+	}
+
+	user, ok := requireProxyAuthorization(w, r)
+	if !ok {
+		return
+	}
+
+	if owner := r.URL.Query().Get("user"); owner != "" && owner != user {
+		if !config.IsProxyAdmin(user) {
+			shared.ErrorForbidden(r).Send(w, r)
+			return
+		}
+		user = owner
+		if owner == "*" {
+			user = ""
+		}
+	}
+
+	records, err := shared.ListProxyLinkRecords(user)
+	if err != nil {
+		shared.SendError(w, r, err)
+		return
+	}
+
+	data := proxyLinkRecordsData{Items: make([]*proxyLinkRecordInfo, len(records)), TotalItems: len(records)}
+	for i, plr := range records {
+		data.Items[i] = newProxyLinkRecordInfo(plr)
+	}
+	shared.SendResponse(w, r, 200, data, nil)
+}
+
+// handleProxyLinkRecord returns or revokes link id created by the
+// authenticated user, admins can act on the links of every user.
+func handleProxyLinkRecord(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	isGetReq := shared.IsMethod(r, http.MethodGet)
+	if !isGetReq && !shared.IsMethod(r, http.MethodDelete) {
+		shared.ErrorMethodNotAllowed(r).Send(w, r)
+		return
+	}
+
+	user, ok := requireProxyAuthorization(w, r)
+	if !ok {
+		return
+	}
+	if config.IsProxyAdmin(user) {
+		user = ""
+	}
+
+	if !isGetReq {
+		if err := shared.RevokeProxyLink(user, id); err != nil {
+			shared.SendError(w, r, err)
+			return
+		}
+		server.GetReqCtx(r).Log.Info("[proxy] link revoked", "id", id)
+		shared.AuditProxyLinkRevoked(r, user, id)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	plr, err := shared.GetProxyLinkRecord(user, id)
+	if err != nil {
+		shared.SendError(w, r, err)
+		return
+	}
+	shared.SendResponse(w, r, 200, newProxyLinkRecordInfo(plr), nil)
+}
@@ -0,0 +1,256 @@
+package endpoint
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Dydhzo/stremthru-proxy/internal/config"
+	"github.com/Dydhzo/stremthru-proxy/internal/server"
+	"github.com/Dydhzo/stremthru-proxy/internal/shared"
+	"github.com/stretchr/testify/suite"
+)
+
+// testAPIError is the part of an error response the tests look at
+type testAPIError struct {
+	Message    string `json:"message"`
+	StatusCode int    `json:"status_code"`
+}
+
+// testProxifyLinksResponse is the response of a link creation request
+type testProxifyLinksResponse struct {
+	Data struct {
+		Items   []string `json:"items"`
+		Results []struct {
+			URL   string        `json:"url"`
+			Error *testAPIError `json:"error"`
+			proxyLinkMetadata
+		} `json:"results"`
+		TotalItems int `json:"total_items"`
+	} `json:"data"`
+	Error *testAPIError `json:"error"`
+}
+
+type ProxifyLinksTestSuite struct {
+	suite.Suite
+	server *httptest.Server
+}
+
+func (s *ProxifyLinksTestSuite) SetupSuite() {
+	config.ProxyAuth["endpoint"] = "pass"
+	mux := http.NewServeMux()
+	AddProxyEndpoints(mux)
+	s.server = httptest.NewServer(shared.RootServerContext(mux))
+}
+
+func (s *ProxifyLinksTestSuite) TearDownSuite() {
+	s.server.Close()
+	delete(config.ProxyAuth, "endpoint")
+}
+
+func (s *ProxifyLinksTestSuite) do(method, path, contentType, body string) (int, []byte) {
+	req, err := http.NewRequest(method, s.server.URL+path, strings.NewReader(body))
+	s.Require().NoError(err)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.Header.Set(server.HEADER_STREMTHRU_AUTHORIZATION, "endpoint:pass")
+	res, err := http.DefaultClient.Do(req)
+	s.Require().NoError(err)
+	defer res.Body.Close()
+	blob, err := io.ReadAll(res.Body)
+	s.Require().NoError(err)
+	return res.StatusCode, blob
+}
+
+func (s *ProxifyLinksTestSuite) proxify(contentType, body string) (int, *testProxifyLinksResponse) {
+	status, blob := s.do("POST", "/v0/proxy", contentType, body)
+	res := &testProxifyLinksResponse{}
+	s.Require().NoError(json.Unmarshal(blob, res), string(blob))
+	return status, res
+}
+
+func (s *ProxifyLinksTestSuite) TestFormItemErrors() {
+	form := url.Values{"url": {
+		"ftp://1.1.1.1/video.mkv",
+		"https://1.1.1.1/video.mkv",
+		"http://127.0.0.1/video.mkv",
+		"1.1.1.1/video.mkv",
+	}}
+	status, res := s.proxify("application/x-www-form-urlencoded", form.Encode())
+	s.Equal(http.StatusOK, status)
+	s.Require().Len(res.Data.Results, 4)
+	s.Equal(4, res.Data.TotalItems)
+
+	s.Require().NotNil(res.Data.Results[0].Error)
+	s.Equal(http.StatusBadRequest, res.Data.Results[0].Error.StatusCode)
+	s.Contains(res.Data.Results[0].Error.Message, "unsupported scheme")
+	s.Empty(res.Data.Items[0])
+
+	s.Nil(res.Data.Results[1].Error)
+	s.Contains(res.Data.Results[1].URL, "/v0/proxy/")
+	s.Equal(res.Data.Results[1].URL, res.Data.Items[1])
+
+	s.Require().NotNil(res.Data.Results[2].Error)
+	s.Equal(http.StatusForbidden, res.Data.Results[2].Error.StatusCode)
+
+	s.Require().NotNil(res.Data.Results[3].Error)
+	s.Contains(res.Data.Results[3].Error.Message, "missing scheme")
+}
+
+func (s *ProxifyLinksTestSuite) TestJSON() {
+	status, res := s.proxify("application/json", `[{
+		"url": "https://1.1.1.1/video.mkv",
+		"filename": "movie.mkv",
+		"exp": "1h",
+		"tunnel": "none",
+		"methods": ["post"],
+		"max_uses": 3,
+		"allowed_ips": ["10.0.0.0/8"],
+		"options": {"encrypt": false}
+	}]`)
+	s.Equal(http.StatusOK, status)
+	s.Require().Len(res.Data.Results, 1)
+	result := res.Data.Results[0]
+	s.Require().Nil(result.Error)
+	s.Equal(result.URL, res.Data.Items[0])
+	s.True(strings.HasSuffix(result.URL, "/movie.mkv"), result.URL)
+	s.Equal("none", result.Tunnel)
+	s.False(result.Encrypted)
+	s.Equal([]string{"POST"}, result.Methods)
+	s.Equal(3, result.MaxUses)
+	s.Equal([]string{"10.0.0.0/8"}, result.AllowedIPs)
+	s.NotEmpty(result.ExpiresAt)
+
+	token, _, _ := strings.Cut(strings.TrimPrefix(result.URL, s.server.URL+"/v0/proxy/"), "/")
+	status, blob := s.do("GET", "/v0/proxy/"+token+"/info", "", "")
+	s.Equal(http.StatusOK, status, string(blob))
+	info := struct {
+		Data proxyLinkMetadata `json:"data"`
+	}{}
+	s.Require().NoError(json.Unmarshal(blob, &info))
+	s.Equal(result.TokenID, info.Data.TokenID)
+	s.Equal("none", info.Data.Tunnel)
+	s.Equal([]string{"POST"}, info.Data.Methods)
+	s.Equal(3, info.Data.MaxUses)
+	s.Equal([]string{"10.0.0.0/8"}, info.Data.AllowedIPs)
+	s.Equal(result.ExpiresAt, info.Data.ExpiresAt)
+
+	status, _ = s.do("POST", "/v0/proxy/"+token+"/info", "", "")
+	s.Equal(http.StatusMethodNotAllowed, status)
+}
+
+func (s *ProxifyLinksTestSuite) TestReservedFilename() {
+	status, res := s.proxify("application/json", `[{"url": "https://1.1.1.1/video.mkv", "filename": "info"}]`)
+	s.Equal(http.StatusOK, status)
+	s.Require().Len(res.Data.Results, 1)
+	s.Require().NotNil(res.Data.Results[0].Error)
+	s.Equal(http.StatusBadRequest, res.Data.Results[0].Error.StatusCode)
+}
+
+func (s *ProxifyLinksTestSuite) TestJSONItemErrors() {
+	status, res := s.proxify("application/json", `[
+		{"url": "https://1.1.1.1/a.mkv", "tunnel": "sideways"},
+		{"url": "https://1.1.1.1/b.mkv", "allowed_ips": ["not-an-ip"]},
+		{"url": "ftp://1.1.1.1/c.mkv"},
+		{"url": "https://1.1.1.1/d.mkv"}
+	]`)
+	s.Equal(http.StatusOK, status)
+	s.Require().Len(res.Data.Results, 4)
+	for i, result := range res.Data.Results[:3] {
+		s.Require().NotNil(result.Error, i)
+		s.Equal(http.StatusBadRequest, result.Error.StatusCode, i)
+		s.Empty(res.Data.Items[i], i)
+	}
+	s.Contains(res.Data.Results[0].Error.Message, "invalid tunnel type")
+	s.Nil(res.Data.Results[3].Error)
+	s.NotEmpty(res.Data.Items[3])
+}
+
+func (s *ProxifyLinksTestSuite) TestJSONInvalidRequest() {
+	for name, body := range map[string]string{
+		"malformed":     `[{"url": `,
+		"unknown field": `[{"url": "https://1.1.1.1/a.mkv", "encrypt": true}]`,
+		"not an array":  `{"url": "https://1.1.1.1/a.mkv"}`,
+		"empty":         `[]`,
+		"bad expiry":    `[{"url": "https://1.1.1.1/a.mkv", "exp": -1}]`,
+	} {
+		status, res := s.proxify("application/json", body)
+		s.Equal(http.StatusBadRequest, status, name)
+		s.Require().NotNil(res.Error, name)
+		s.Empty(res.Data.Results, name)
+	}
+}
+
+func (s *ProxifyLinksTestSuite) TestLinkRecord() {
+	_, res := s.proxify("application/json", `[{"url": "https://1.1.1.1/video.mkv", "filename": "links"}]`)
+	s.Require().Len(res.Data.Results, 1)
+	result := res.Data.Results[0]
+	s.Require().Nil(result.Error)
+
+	status, blob := s.do("GET", "/v0/proxy/links/"+result.TokenID, "", "")
+	s.Equal(http.StatusOK, status, string(blob))
+	s.Contains(string(blob), `"host":"1.1.1.1"`)
+
+	status, _ = s.do("DELETE", "/v0/proxy/links/"+result.TokenID, "", "")
+	s.Equal(http.StatusNoContent, status)
+	status, _ = s.do("GET", strings.TrimPrefix(result.URL, s.server.URL), "", "")
+	s.Equal(http.StatusGone, status)
+
+	status, _ = s.do("GET", "/v0/proxy/links/"+result.TokenID+"x", "", "")
+	s.Equal(http.StatusNotFound, status)
+}
+
+func TestProxifyLinks(t *testing.T) {
+	suite.Run(t, new(ProxifyLinksTestSuite))
+}
+
+type ServeProxyLinkTestSuite struct {
+	suite.Suite
+}
+
+func (s *ServeProxyLinkTestSuite) serve(method string, link *shared.ProxyLink) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, "/v0/proxy/token", strings.NewReader("payload"))
+	r = server.SetReqCtx(r, &server.ReqCtx{StartTime: time.Now(), Log: slog.Default()})
+	w := httptest.NewRecorder()
+	serveProxyLink(w, r, link)
+	return w
+}
+
+func (s *ServeProxyLinkTestSuite) link(methods ...string) *shared.ProxyLink {
+	return &shared.ProxyLink{
+		User:       "endpoint",
+		URL:        "http://127.0.0.1:1/video.mkv",
+		TunnelType: config.TUNNEL_TYPE_NONE,
+		ExpiresAt:  time.Now().Add(time.Hour),
+		Methods:    methods,
+	}
+}
+
+func (s *ServeProxyLinkTestSuite) TestMethodNotAllowed() {
+	w := s.serve("POST", s.link())
+	s.Equal(http.StatusMethodNotAllowed, w.Code)
+	s.Equal("GET, HEAD", w.Header().Get("Allow"))
+
+	w = s.serve("DELETE", s.link("POST"))
+	s.Equal(http.StatusMethodNotAllowed, w.Code)
+	s.Equal("GET, HEAD, POST", w.Header().Get("Allow"))
+}
+
+func (s *ServeProxyLinkTestSuite) TestMethodAllowed() {
+	// reaches the upstream request, where the address guard stops it
+	w := s.serve("POST", s.link("POST"))
+	s.Equal(http.StatusForbidden, w.Code)
+	s.Contains(w.Body.String(), config.ErrSSRFBlocked.Error())
+	s.Empty(w.Header().Get("Allow"))
+}
+
+func TestServeProxyLink(t *testing.T) {
+	suite.Run(t, new(ServeProxyLinkTestSuite))
+}
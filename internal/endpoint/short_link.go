@@ -0,0 +1,125 @@
+package endpoint
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/Dydhzo/stremthru-proxy/internal/server"
+	"github.com/Dydhzo/stremthru-proxy/internal/shared"
+	"github.com/Dydhzo/stremthru-proxy/internal/tracing"
+)
+
+// handleShortLinkAccess serves proxied content via a stored short link
+func handleShortLinkAccess(w http.ResponseWriter, r *http.Request) {
+	ctx := server.GetReqCtx(r)
+	ctx.RedactURLPathValues(r, "shortId")
+
+	_, span := tracing.Start(r.Context(), "proxy.short_link_lookup")
+	link, err := shared.AccessShortProxyLink(r.PathValue("shortId"))
+	tracing.End(span, err)
+	if err != nil {
+		shared.SendError(w, r, err)
+		shared.AuditProxyLinkAccess(w, r, nil, 0)
+		return
+	}
+
+	serveProxyLink(w, r, link)
+}
+
+// shortLinkInfo represents a stored short link, without the upstream url
+type shortLinkInfo struct {
+	*proxyLinkMetadata
+	URL          string `json:"url"`
+	CreatedAt    string `json:"created_at"`
+	Hits         int64  `json:"hits"`
+	LastAccessAt string `json:"last_access_at,omitempty"`
+}
+
+func newShortLinkInfo(r *http.Request, sl *shared.ShortLink) *shortLinkInfo {
+	info := &shortLinkInfo{
+		proxyLinkMetadata: newProxyLinkMetadata(sl.ProxyLink, ""),
+		URL:               shared.ExtractRequestBaseURL(r).String() + "/v0/p/" + sl.ID,
+		CreatedAt:         sl.CreatedAt.UTC().Format(time.RFC3339),
+		Hits:              sl.Hits,
+	}
+	if !sl.LastAccessAt.IsZero() {
+		info.LastAccessAt = sl.LastAccessAt.UTC().Format(time.RFC3339)
+	}
+	return info
+}
+
+// shortLinksData represents response for short link listing
+type shortLinksData struct {
+	Items      []*shortLinkInfo `json:"items"`
+	TotalItems int              `json:"total_items"`
+}
+
+// handleShortLinks lists the short links of the authenticated user
+func handleShortLinks(w http.ResponseWriter, r *http.Request) {
+	if !shared.IsMethod(r, http.MethodGet) {
+		shared.ErrorMethodNotAllowed(r).Send(w, r)
+		return
+	}
+
+	user, ok := requireProxyAuthorization(w, r)
+	if !ok {
+		return
+	}
+
+	links, err := shared.ListShortProxyLinks(user)
+	if err != nil {
+		shared.SendError(w, r, err)
+		return
+	}
+
+	data := shortLinksData{Items: make([]*shortLinkInfo, len(links)), TotalItems: len(links)}
+	for i, sl := range links {
+		data.Items[i] = newShortLinkInfo(r, sl)
+	}
+	shared.SendResponse(w, r, 200, data, nil)
+}
+
+// handleShortLinkInfo returns or deletes a short link of the authenticated user
+func handleShortLinkInfo(w http.ResponseWriter, r *http.Request) {
+	ctx := server.GetReqCtx(r)
+	ctx.RedactURLPathValues(r, "shortId")
+
+	isGetReq := shared.IsMethod(r, http.MethodGet)
+	if !isGetReq && !shared.IsMethod(r, http.MethodDelete) {
+		shared.ErrorMethodNotAllowed(r).Send(w, r)
+		return
+	}
+
+	user, ok := requireProxyAuthorization(w, r)
+	if !ok {
+		return
+	}
+
+	id := r.PathValue("shortId")
+	if !isGetReq {
+		if err := shared.DeleteShortProxyLink(user, id); err != nil {
+			shared.SendError(w, r, err)
+			return
+		}
+		shared.AuditProxyLinkRevoked(r, user, id)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	sl, err := shared.GetShortProxyLink(user, id)
+	if err != nil {
+		shared.SendError(w, r, err)
+		return
+	}
+	shared.SendResponse(w, r, 200, newShortLinkInfo(r, sl), nil)
+}
+
+// AddShortLinkEndpoints registers short link HTTP endpoints
+func AddShortLinkEndpoints(mux *http.ServeMux) {
+	withCors := shared.Middleware(shared.EnableCORS, shared.GuardClient)
+
+	mux.HandleFunc("/v0/p", withCors(handleShortLinks))
+	mux.HandleFunc("/v0/p/{shortId}", withCors(handleShortLinkAccess))
+	mux.HandleFunc("/v0/p/info/{shortId}", withCors(handleShortLinkInfo))
+	mux.HandleFunc("/v0/p/{shortId}/{filename}", withCors(handleShortLinkAccess))
+}
@@ -0,0 +1,60 @@
+package endpoint
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Dydhzo/stremthru-proxy/internal/config"
+	"github.com/Dydhzo/stremthru-proxy/internal/shared"
+	"github.com/stretchr/testify/suite"
+)
+
+type ShortLinkTestSuite struct {
+	suite.Suite
+	server *httptest.Server
+	guard  config.ClientGuardConfig
+}
+
+func (s *ShortLinkTestSuite) SetupSuite() {
+	mux := http.NewServeMux()
+	AddShortLinkEndpoints(mux)
+	s.server = httptest.NewServer(shared.RootServerContext(mux))
+}
+
+func (s *ShortLinkTestSuite) TearDownSuite() {
+	s.server.Close()
+}
+
+func (s *ShortLinkTestSuite) SetupTest() {
+	s.guard = config.ClientGuard
+	config.ClientGuard = config.ClientGuardConfig{
+		FailureLimit:   2,
+		FailureWindow:  time.Minute,
+		BanDuration:    time.Minute,
+		MaxBanDuration: time.Minute,
+	}
+}
+
+func (s *ShortLinkTestSuite) TearDownTest() {
+	config.ClientGuard = s.guard
+}
+
+func (s *ShortLinkTestSuite) get(path string) int {
+	res, err := http.Get(s.server.URL + path)
+	s.Require().NoError(err)
+	res.Body.Close()
+	return res.StatusCode
+}
+
+func (s *ShortLinkTestSuite) TestUnknownNotBanned() {
+	// players retry links that are gone, it is not a guessing attempt
+	for range 3 {
+		s.Equal(http.StatusNotFound, s.get("/v0/p/unknownshort"))
+	}
+}
+
+func TestShortLink(t *testing.T) {
+	suite.Run(t, new(ShortLinkTestSuite))
+}
@@ -9,6 +9,7 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/Dydhzo/stremthru-proxy/internal/cache"
 	"github.com/Dydhzo/stremthru-proxy/internal/shared"
 )
 
@@ -37,6 +38,8 @@ func init() {
 type StatsData struct {
 	ActiveConnections     int32 `json:"active_connections"`
 	SystemNetworkStats    *SystemNetworkStats `json:"system_network,omitempty"`
+	Caches                []cache.CacheStats  `json:"caches"`
+	Guard                 shared.GuardStats   `json:"guard"`
 }
 
 // SystemNetworkStats represents system-wide network statistics
@@ -164,6 +167,8 @@ func handleStats(w http.ResponseWriter, r *http.Request) {
 	stats := &StatsData{
 		ActiveConnections:     connections,
 		SystemNetworkStats:    getSystemNetworkStats(),
+		Caches:                cache.AllStats(),
+		Guard:                 shared.GetGuardStats(),
 	}
 
 	shared.SendResponse(w, r, 200, stats, nil)
@@ -171,5 +176,5 @@ func handleStats(w http.ResponseWriter, r *http.Request) {
 
 // AddStatsEndpoint registers statistics HTTP endpoint
 func AddStatsEndpoint(mux *http.ServeMux) {
-	mux.HandleFunc("/v0/stats", handleStats)
+	mux.HandleFunc("/v0/stats", shared.GuardClient(handleStats))
 }
\ No newline at end of file
@@ -0,0 +1,168 @@
+package logger
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RotatingFile appends to a file, renaming it with a timestamp suffix once
+// it reaches maxSize and keeping the maxFiles most recent renamed files,
+// all of them when zero.
+type RotatingFile struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+const rotatedFileTimeFormat = "20060102T150405.000"
+
+func OpenRotatingFile(path string, maxSize int64, maxFiles int) (*RotatingFile, error) {
+	f := &RotatingFile{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size = file, info.Size()
+	return nil
+}
+
+// rotatedPath returns the name of the file rotated at t, like
+// audit-20261019T120000.000.log for audit.log
+func (f *RotatingFile) rotatedPath(t time.Time) string {
+	ext := filepath.Ext(f.path)
+	return strings.TrimSuffix(f.path, ext) + "-" + t.UTC().Format(rotatedFileTimeFormat) + ext
+}
+
+func (f *RotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.path, f.rotatedPath(time.Now())); err != nil {
+		return err
+	}
+	if err := f.open(); err != nil {
+		return err
+	}
+	return f.prune()
+}
+
+// rotatedFiles returns the rotated files, oldest first
+func (f *RotatingFile) rotatedFiles() ([]string, error) {
+	ext := filepath.Ext(f.path)
+	files, err := filepath.Glob(strings.TrimSuffix(f.path, ext) + "-*" + ext)
+	if err != nil {
+		return nil, err
+	}
+	slices.Sort(files)
+	return files, nil
+}
+
+func (f *RotatingFile) prune() error {
+	if f.maxFiles == 0 {
+		return nil
+	}
+	files, err := f.rotatedFiles()
+	if err != nil {
+		return err
+	}
+	for len(files) > f.maxFiles {
+		if err := os.Remove(files[0]); err != nil {
+			return err
+		}
+		files = files[1:]
+	}
+	return nil
+}
+
+// Write appends p, rotating first when it would grow the file past its max
+// size. p is never split across files.
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *RotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.file.Close()
+}
+
+// LastLine returns the last complete line written to the file, or to the
+// most recent rotated file when the file is empty.
+func (f *RotatingFile) LastLine() ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	path := f.path
+	if f.size == 0 {
+		files, err := f.rotatedFiles()
+		if err != nil || len(files) == 0 {
+			return nil, err
+		}
+		path = files[len(files)-1]
+	}
+	return readLastLine(path)
+}
+
+// Longest line looked up by readLastLine
+const maxLastLineSize = 64 << 10
+
+func readLastLine(path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	offset := max(info.Size()-maxLastLineSize, 0)
+	buf := make([]byte, info.Size()-offset)
+	if _, err := file.ReadAt(buf, offset); err != nil && err != io.EOF {
+		return nil, err
+	}
+	buf = bytes.TrimRight(buf, "\n")
+	if i := bytes.LastIndexByte(buf, '\n'); i != -1 {
+		buf = buf[i+1:]
+	} else if offset > 0 {
+		return nil, nil
+	}
+	return buf, nil
+}
@@ -0,0 +1,61 @@
+package logger
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type RotatingFileTestSuite struct {
+	suite.Suite
+	path string
+}
+
+func (s *RotatingFileTestSuite) SetupTest() {
+	s.path = filepath.Join(s.T().TempDir(), "logs", "access.log")
+}
+
+func (s *RotatingFileTestSuite) TestRotate() {
+	f, err := OpenRotatingFile(s.path, 10, 2)
+	s.Require().NoError(err)
+	defer f.Close()
+
+	for _, line := range []string{"line one\n", "line two\n", "line three\n", "line four\n"} {
+		_, err := f.Write([]byte(line))
+		s.Require().NoError(err)
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	rotated, err := f.rotatedFiles()
+	s.Require().NoError(err)
+	s.Len(rotated, 2, "oldest rotated file is removed")
+	blob, err := os.ReadFile(rotated[0])
+	s.Require().NoError(err)
+	s.Equal("line two\n", string(blob))
+	blob, err = os.ReadFile(s.path)
+	s.Require().NoError(err)
+	s.Equal("line four\n", string(blob))
+}
+
+func (s *RotatingFileTestSuite) TestLastLine() {
+	f, err := OpenRotatingFile(s.path, 16, 0)
+	s.Require().NoError(err)
+	defer f.Close()
+
+	line, err := f.LastLine()
+	s.Require().NoError(err)
+	s.Empty(line)
+
+	f.Write([]byte("first\n"))
+	f.Write([]byte("second\n"))
+	line, err = f.LastLine()
+	s.Require().NoError(err)
+	s.Equal("second", string(line))
+}
+
+func TestRotatingFile(t *testing.T) {
+	suite.Run(t, new(RotatingFileTestSuite))
+}
@@ -14,10 +14,15 @@ type reqCtxKey struct{}
 type ReqCtx struct {
 	StartTime time.Time
 	RequestId string
+	ClientIP  string
 	Error     error
 	ReqPath   string
 	ReqQuery  url.Values
 	Log       *slog.Logger
+	// Authenticated user or owner of the link served, for the access log
+	User string
+	// Host of the last upstream requested, for the access log
+	UpstreamHost string
 }
 
 func (ctx *ReqCtx) RedactURLPathValues(r *http.Request, names ...string) {
@@ -0,0 +1,137 @@
+package shared
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Dydhzo/stremthru-proxy/internal/config"
+	"github.com/Dydhzo/stremthru-proxy/internal/logger"
+	"github.com/Dydhzo/stremthru-proxy/internal/server"
+	"github.com/Dydhzo/stremthru-proxy/internal/tracing"
+)
+
+// Access log file, nil when the access log is disabled
+var accessLogFile = func() *logger.RotatingFile {
+	if config.AccessLog.File == "" {
+		return nil
+	}
+	c := config.AccessLog
+	file, err := logger.OpenRotatingFile(c.File, c.MaxSize, c.MaxFiles)
+	if err != nil {
+		log.Fatalf("failed to open access log %s: %v", c.File, err)
+	}
+	return file
+}()
+
+// accessLogEntry is a request of the access log, with its path and query
+// redacted like in the server logs
+type accessLogEntry struct {
+	Time         time.Time `json:"time"`
+	RequestID    string    `json:"request_id"`
+	TraceID      string    `json:"trace_id,omitempty"`
+	ClientIP     string    `json:"client_ip"`
+	User         string    `json:"user,omitempty"`
+	Method       string    `json:"method"`
+	Path         string    `json:"path"`
+	Query        string    `json:"query,omitempty"`
+	Proto        string    `json:"proto"`
+	Status       int       `json:"status"`
+	Bytes        int64     `json:"bytes"`
+	Referer      string    `json:"referer,omitempty"`
+	UserAgent    string    `json:"user_agent,omitempty"`
+	UpstreamHost string    `json:"upstream_host,omitempty"`
+	TTFBMs       int64     `json:"ttfb_ms"`
+	DurationMs   int64     `json:"duration_ms"`
+}
+
+func newAccessLogEntry(w *responseWriter, r *http.Request, now time.Time) *accessLogEntry {
+	ctx := server.GetReqCtx(r)
+	entry := &accessLogEntry{
+		Time:         ctx.StartTime,
+		RequestID:    ctx.RequestId,
+		TraceID:      tracing.TraceID(r.Context()),
+		ClientIP:     ctx.ClientIP,
+		User:         ctx.User,
+		Method:       r.Method,
+		Path:         ctx.ReqPath,
+		Query:        ctx.ReqQuery.Encode(),
+		Proto:        r.Proto,
+		Status:       w.getStatusCode(),
+		Bytes:        w.bytesWritten,
+		Referer:      r.Header.Get("Referer"),
+		UserAgent:    r.Header.Get("User-Agent"),
+		UpstreamHost: ctx.UpstreamHost,
+		DurationMs:   now.Sub(ctx.StartTime).Milliseconds(),
+	}
+	if entry.Status == 0 {
+		entry.Status = http.StatusOK
+	}
+	if !w.firstByteAt.IsZero() {
+		entry.TTFBMs = w.firstByteAt.Sub(ctx.StartTime).Milliseconds()
+	}
+	return entry
+}
+
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+// combined formats e in the Apache combined log format, followed by the
+// upstream host, the time to first byte and the total duration in
+// milliseconds
+func (e *accessLogEntry) combined() []byte {
+	target := e.Path
+	if e.Query != "" {
+		target += "?" + e.Query
+	}
+	var b strings.Builder
+	b.WriteString(orDash(e.ClientIP))
+	b.WriteString(" - ")
+	b.WriteString(orDash(e.User))
+	b.WriteString(" [")
+	b.WriteString(e.Time.Format("02/Jan/2006:15:04:05 -0700"))
+	b.WriteString("] ")
+	b.WriteString(strconv.Quote(e.Method + " " + target + " " + e.Proto))
+	b.WriteString(" " + strconv.Itoa(e.Status) + " ")
+	if e.Bytes == 0 {
+		b.WriteString("-")
+	} else {
+		b.WriteString(strconv.FormatInt(e.Bytes, 10))
+	}
+	b.WriteString(" " + strconv.Quote(orDash(e.Referer)))
+	b.WriteString(" " + strconv.Quote(orDash(e.UserAgent)))
+	b.WriteString(" " + strconv.Quote(orDash(e.UpstreamHost)))
+	b.WriteString(" " + strconv.FormatInt(e.TTFBMs, 10))
+	b.WriteString(" " + strconv.FormatInt(e.DurationMs, 10))
+	b.WriteByte('\n')
+	return []byte(b.String())
+}
+
+// writeAccessLog logs the request r once its response w is fully sent
+func writeAccessLog(w *responseWriter, r *http.Request) {
+	if accessLogFile == nil {
+		return
+	}
+	entry := newAccessLogEntry(w, r, time.Now())
+	var line []byte
+	if config.AccessLog.Format == config.ACCESS_LOG_FORMAT_JSON {
+		blob, err := json.Marshal(entry)
+		if err != nil {
+			reqLog.Error("failed to encode access log", "error", err)
+			return
+		}
+		line = append(blob, '\n')
+	} else {
+		line = entry.combined()
+	}
+	if _, err := accessLogFile.Write(line); err != nil {
+		reqLog.Error("failed to write access log", "error", err)
+	}
+}
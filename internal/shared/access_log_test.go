@@ -0,0 +1,80 @@
+package shared
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Dydhzo/stremthru-proxy/internal/config"
+	"github.com/Dydhzo/stremthru-proxy/internal/logger"
+	"github.com/Dydhzo/stremthru-proxy/internal/server"
+	"github.com/stretchr/testify/suite"
+)
+
+type AccessLogTestSuite struct {
+	suite.Suite
+	path   string
+	config config.AccessLogConfig
+}
+
+func (s *AccessLogTestSuite) SetupTest() {
+	s.path = filepath.Join(s.T().TempDir(), "access.log")
+	s.config = config.AccessLog
+	file, err := logger.OpenRotatingFile(s.path, 1<<20, 0)
+	s.Require().NoError(err)
+	accessLogFile = file
+}
+
+func (s *AccessLogTestSuite) TearDownTest() {
+	accessLogFile.Close()
+	accessLogFile = nil
+	config.AccessLog = s.config
+}
+
+func (s *AccessLogTestSuite) serve() string {
+	handler := RootServerContext(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := server.GetReqCtx(r)
+		ctx.RedactURLQueryParams(r, "token")
+		ctx.User = "alice"
+		ctx.UpstreamHost = "example.com"
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write([]byte("hello"))
+	}))
+	r := httptest.NewRequest("GET", "/v0/proxy/abc?token=secret", nil)
+	r.Header.Set("User-Agent", "test")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	blob, err := os.ReadFile(s.path)
+	s.Require().NoError(err)
+	return string(blob)
+}
+
+func (s *AccessLogTestSuite) TestCombined() {
+	config.AccessLog.Format = config.ACCESS_LOG_FORMAT_COMBINED
+	line := s.serve()
+	s.NotContains(line, "secret")
+	s.Contains(line, " - alice [")
+	s.Contains(line, `"GET /v0/proxy/abc?token=...redacted... HTTP/1.1" 206 5 "-" "test" "example.com" `)
+	s.True(strings.HasSuffix(line, "\n"))
+}
+
+func (s *AccessLogTestSuite) TestJSON() {
+	config.AccessLog.Format = config.ACCESS_LOG_FORMAT_JSON
+	entry := &accessLogEntry{}
+	s.Require().NoError(json.Unmarshal([]byte(s.serve()), entry))
+	s.Equal("alice", entry.User)
+	s.Equal(http.StatusPartialContent, entry.Status)
+	s.Equal(int64(5), entry.Bytes)
+	s.Equal("example.com", entry.UpstreamHost)
+	s.Equal("/v0/proxy/abc", entry.Path)
+	s.WithinDuration(time.Now(), entry.Time, time.Minute)
+}
+
+func TestAccessLog(t *testing.T) {
+	suite.Run(t, new(AccessLogTestSuite))
+}
@@ -0,0 +1,239 @@
+package shared
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Dydhzo/stremthru-proxy/core"
+	"github.com/Dydhzo/stremthru-proxy/internal/config"
+	"github.com/Dydhzo/stremthru-proxy/internal/logger"
+	"github.com/Dydhzo/stremthru-proxy/internal/server"
+)
+
+var auditLog = logger.Scoped("audit")
+
+const (
+	auditEventLinkCreate = "link.create"
+	auditEventLinkAccess = "link.access"
+	auditEventLinkRevoke = "link.revoke"
+	auditEventChainBreak = "chain.break"
+)
+
+// auditEntry is a line of the audit log. Hash is the HMAC-SHA256, keyed by
+// the server secret, of the line without its hash field, which is always
+// last, and Prev the hash of the previous line, so any edited, removed or
+// reordered line breaks the chain.
+type auditEntry struct {
+	Time      time.Time `json:"time"`
+	Seq       int64     `json:"seq"`
+	Event     string    `json:"event"`
+	RequestID string    `json:"request_id,omitempty"`
+	ClientIP  string    `json:"client_ip,omitempty"`
+	User      string    `json:"user,omitempty"`
+	LinkID    string    `json:"link_id,omitempty"`
+
+	UpstreamHost    string    `json:"upstream_host,omitempty"`
+	UpstreamURL     string    `json:"upstream_url,omitempty"`
+	UpstreamURLHash string    `json:"upstream_url_hash,omitempty"`
+	ExpiresAt       time.Time `json:"expires_at,omitzero"`
+	Short           bool      `json:"short,omitempty"`
+
+	Method     string `json:"method,omitempty"`
+	Range      string `json:"range,omitempty"`
+	Status     int    `json:"status,omitempty"`
+	Bytes      int64  `json:"bytes,omitempty"`
+	DurationMs int64  `json:"duration_ms,omitempty"`
+
+	// why a chain.break starts a new chain
+	Reason string `json:"reason,omitempty"`
+
+	Prev string `json:"prev"`
+	Hash string `json:"hash,omitempty"`
+}
+
+// Interval of the checkpoints logged to the server logs. Lines removed from
+// the end of the audit log are only noticed up to the last checkpoint.
+const auditCheckpointInterval = 5 * time.Minute
+
+type auditSink struct {
+	mu   sync.Mutex
+	file *logger.RotatingFile
+	seq  int64
+	prev string
+	// when the last checkpoint was logged
+	checkpointAt time.Time
+}
+
+// newAuditSink opens the audit log at path, continuing the hash chain of
+// its last line. An unreadable last line, like one cut by a crash, is kept
+// and followed by a chain.break line starting a new chain.
+func newAuditSink(c config.LogFileConfig) (*auditSink, error) {
+	file, err := logger.OpenRotatingFile(c.File, c.MaxSize, c.MaxFiles)
+	if err != nil {
+		return nil, err
+	}
+	sink := &auditSink{file: file}
+	line, err := file.LastLine()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if len(line) == 0 {
+		return sink, nil
+	}
+	last := &auditEntry{}
+	if err := json.Unmarshal(line, last); err == nil && last.Hash != "" {
+		sink.seq, sink.prev = last.Seq, last.Hash
+		return sink, nil
+	}
+
+	auditLog.Warn("audit log last line unreadable, starting a new chain", "file", c.File)
+	if isPartial, err := hasPartialLastLine(c.File); err != nil || isPartial {
+		if err == nil {
+			_, err = file.Write([]byte{'\n'})
+		}
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	if err := sink.write(&auditEntry{Time: time.Now().UTC(), Event: auditEventChainBreak, Reason: "last line unreadable"}); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return sink, nil
+}
+
+// hasPartialLastLine reports whether the file at path does not end with a newline
+func hasPartialLastLine(path string) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil || info.Size() == 0 {
+		return false, err
+	}
+	last := make([]byte, 1)
+	if _, err := file.ReadAt(last, info.Size()-1); err != nil {
+		return false, err
+	}
+	return last[0] != '\n', nil
+}
+
+func (s *auditSink) write(entry *auditEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry.Seq = s.seq + 1
+	entry.Prev = s.prev
+	entry.Hash = ""
+	blob, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	entry.Hash = hex.EncodeToString(core.AuditHash(blob))
+	if blob, err = json.Marshal(entry); err != nil {
+		return err
+	}
+	if _, err := s.file.Write(append(blob, '\n')); err != nil {
+		return err
+	}
+	s.seq, s.prev = entry.Seq, entry.Hash
+	if time.Since(s.checkpointAt) >= auditCheckpointInterval {
+		s.checkpointAt = time.Now()
+		auditLog.Info("audit log checkpoint", "seq", s.seq, "hash", s.prev)
+	}
+	return nil
+}
+
+// Audit sink, nil when the audit log is disabled
+var audit = func() *auditSink {
+	if config.AuditLog.File == "" {
+		return nil
+	}
+	sink, err := newAuditSink(config.AuditLog.LogFileConfig)
+	if err != nil {
+		log.Fatalf("failed to open audit log %s: %v", config.AuditLog.File, err)
+	}
+	return sink
+}()
+
+func newAuditEntry(r *http.Request, event string) *auditEntry {
+	ctx := server.GetReqCtx(r)
+	return &auditEntry{
+		Time:      time.Now().UTC(),
+		Event:     event,
+		RequestID: ctx.RequestId,
+		ClientIP:  ctx.ClientIP,
+	}
+}
+
+func writeAuditEntry(entry *auditEntry) {
+	if err := audit.write(entry); err != nil {
+		auditLog.Error("failed to write audit log", "event", entry.Event, "link_id", entry.LinkID, "error", err)
+	}
+}
+
+// AuditProxyLinkCreated logs the creation of link, with its upstream url
+// hashed when configured
+func AuditProxyLinkCreated(r *http.Request, link *ProxyLink, short bool) {
+	if audit == nil {
+		return
+	}
+	entry := newAuditEntry(r, auditEventLinkCreate)
+	entry.User = link.User
+	entry.LinkID = link.ID
+	entry.ExpiresAt = link.ExpiresAt
+	entry.Short = short
+	if u, err := url.Parse(link.URL); err == nil {
+		entry.UpstreamHost = u.Host
+	}
+	if config.AuditLog.HashURLs {
+		entry.UpstreamURLHash = base64.RawURLEncoding.EncodeToString(core.TokenSignature([]byte("url:" + link.URL)))
+	} else {
+		entry.UpstreamURL = link.URL
+	}
+	writeAuditEntry(entry)
+}
+
+// AuditProxyLinkAccess logs an access to link, nil when its token or short
+// id was not valid, once the response w is sent
+func AuditProxyLinkAccess(w http.ResponseWriter, r *http.Request, link *ProxyLink, bytesWritten int64) {
+	if audit == nil {
+		return
+	}
+	entry := newAuditEntry(r, auditEventLinkAccess)
+	if link != nil {
+		entry.User = link.User
+		entry.LinkID = link.ID
+	}
+	entry.Method = r.Method
+	entry.Range = r.Header.Get("Range")
+	entry.Status = http.StatusOK
+	if rw, ok := w.(ResponseWriter); ok && rw.getStatusCode() != 0 {
+		entry.Status = rw.getStatusCode()
+	}
+	entry.Bytes = bytesWritten
+	entry.DurationMs = time.Since(server.GetReqCtx(r).StartTime).Milliseconds()
+	writeAuditEntry(entry)
+}
+
+// AuditProxyLinkRevoked logs the revocation of the link id by user
+func AuditProxyLinkRevoked(r *http.Request, user, id string) {
+	if audit == nil {
+		return
+	}
+	entry := newAuditEntry(r, auditEventLinkRevoke)
+	entry.User = user
+	entry.LinkID = id
+	writeAuditEntry(entry)
+}
@@ -0,0 +1,160 @@
+package shared
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Dydhzo/stremthru-proxy/core"
+	"github.com/Dydhzo/stremthru-proxy/internal/config"
+	"github.com/Dydhzo/stremthru-proxy/internal/server"
+	"github.com/stretchr/testify/suite"
+)
+
+type AuditTestSuite struct {
+	suite.Suite
+	path     string
+	config   config.AuditLogConfig
+	previous *auditSink
+}
+
+func (s *AuditTestSuite) SetupTest() {
+	s.path = filepath.Join(s.T().TempDir(), "audit.log")
+	s.config = config.AuditLog
+	s.previous = audit
+	config.AuditLog = config.AuditLogConfig{LogFileConfig: config.LogFileConfig{File: s.path, MaxSize: 1 << 20}}
+	s.open()
+}
+
+func (s *AuditTestSuite) TearDownTest() {
+	audit.file.Close()
+	config.AuditLog = s.config
+	audit = s.previous
+}
+
+func (s *AuditTestSuite) open() {
+	sink, err := newAuditSink(config.AuditLog.LogFileConfig)
+	s.Require().NoError(err)
+	audit = sink
+}
+
+func (s *AuditTestSuite) request() *http.Request {
+	r := httptest.NewRequest("GET", "/v0/proxy/token", nil)
+	r.Header.Set("Range", "bytes=0-99")
+	return server.SetReqCtx(r, &server.ReqCtx{StartTime: time.Now(), RequestId: "req", ClientIP: "192.0.2.1"})
+}
+
+// lines returns the raw lines of the audit log, checking the hash chain
+func (s *AuditTestSuite) lines() []map[string]any {
+	file, err := os.Open(s.path)
+	s.Require().NoError(err)
+	defer file.Close()
+
+	entries := []map[string]any{}
+	prev := ""
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		i := strings.LastIndex(line, `,"hash":"`)
+		s.Require().NotEqual(-1, i)
+		sum := core.AuditHash([]byte(line[:i] + "}"))
+
+		entry := map[string]any{}
+		s.Require().NoError(json.Unmarshal([]byte(line), &entry))
+		s.Equal(hex.EncodeToString(sum), entry["hash"])
+		s.Equal(prev, entry["prev"])
+		prev = entry["hash"].(string)
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func (s *AuditTestSuite) TestChain() {
+	link := &ProxyLink{ID: "id", User: "alice", URL: "https://example.com/video.mkv"}
+	AuditProxyLinkCreated(s.request(), link, false)
+	AuditProxyLinkAccess(httptest.NewRecorder(), s.request(), link, 100)
+
+	s.open()
+	AuditProxyLinkRevoked(s.request(), "alice", "id")
+
+	entries := s.lines()
+	s.Require().Len(entries, 3)
+	s.Equal("link.create", entries[0]["event"])
+	s.Equal("example.com", entries[0]["upstream_host"])
+	s.Equal(link.URL, entries[0]["upstream_url"])
+	s.Equal("192.0.2.1", entries[0]["client_ip"])
+	s.Equal("link.access", entries[1]["event"])
+	s.Equal("bytes=0-99", entries[1]["range"])
+	s.Equal(float64(100), entries[1]["bytes"])
+	s.Equal(float64(200), entries[1]["status"])
+	s.Equal("link.revoke", entries[2]["event"])
+	s.Equal(float64(3), entries[2]["seq"], "sequence continues after reopening")
+}
+
+func (s *AuditTestSuite) TestHashURLs() {
+	config.AuditLog.HashURLs = true
+	AuditProxyLinkCreated(s.request(), &ProxyLink{ID: "id", User: "alice", URL: "https://example.com/secret"}, true)
+
+	entries := s.lines()
+	s.Require().Len(entries, 1)
+	s.Nil(entries[0]["upstream_url"])
+	s.NotEmpty(entries[0]["upstream_url_hash"])
+	s.Equal("example.com", entries[0]["upstream_host"])
+	s.Equal(true, entries[0]["short"])
+}
+
+func (s *AuditTestSuite) TestCheckpoint() {
+	AuditProxyLinkRevoked(s.request(), "alice", "a")
+	checkpointAt := audit.checkpointAt
+	s.False(checkpointAt.IsZero(), "first line is checkpointed")
+
+	AuditProxyLinkRevoked(s.request(), "alice", "b")
+	s.Equal(checkpointAt, audit.checkpointAt, "no checkpoint before the interval")
+
+	audit.checkpointAt = audit.checkpointAt.Add(-auditCheckpointInterval)
+	AuditProxyLinkRevoked(s.request(), "alice", "c")
+	s.True(audit.checkpointAt.After(checkpointAt))
+	s.Len(s.lines(), 3)
+}
+
+func (s *AuditTestSuite) TestTruncatedLastLine() {
+	AuditProxyLinkRevoked(s.request(), "alice", "a")
+	audit.file.Close()
+
+	// a crash while writing the second line
+	file, err := os.OpenFile(s.path, os.O_APPEND|os.O_WRONLY, 0)
+	s.Require().NoError(err)
+	_, err = file.WriteString(`{"time":"2026-10-19T12:00:00Z","seq":2,"ev`)
+	s.Require().NoError(err)
+	s.Require().NoError(file.Close())
+
+	s.open()
+	AuditProxyLinkRevoked(s.request(), "alice", "b")
+
+	blob, err := os.ReadFile(s.path)
+	s.Require().NoError(err)
+	lines := strings.Split(strings.TrimSuffix(string(blob), "\n"), "\n")
+	s.Require().Len(lines, 4)
+	s.Equal(`{"time":"2026-10-19T12:00:00Z","seq":2,"ev`, lines[1], "the cut line is kept")
+
+	// the new chain starts at the chain break
+	s.Require().NoError(os.WriteFile(s.path, []byte(strings.Join(lines[2:], "\n")+"\n"), 0o644))
+	entries := s.lines()
+	s.Require().Len(entries, 2)
+	s.Equal("chain.break", entries[0]["event"])
+	s.Equal("last line unreadable", entries[0]["reason"])
+	s.Equal(float64(1), entries[0]["seq"])
+	s.Equal("link.revoke", entries[1]["event"])
+	s.Equal(float64(2), entries[1]["seq"])
+}
+
+func TestAudit(t *testing.T) {
+	suite.Run(t, new(AuditTestSuite))
+}
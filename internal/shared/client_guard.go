@@ -0,0 +1,133 @@
+package shared
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Dydhzo/stremthru-proxy/internal/cache"
+	"github.com/Dydhzo/stremthru-proxy/internal/config"
+	"github.com/Dydhzo/stremthru-proxy/internal/logger"
+	"github.com/Dydhzo/stremthru-proxy/internal/server"
+)
+
+var guardLog = logger.Scoped("guard")
+
+// How long a client is remembered after its last failure, so repeated
+// bans keep growing
+const clientFailuresLifetime = 24 * time.Hour
+
+// clientFailures tracks the failures of a client ip, guarded by clientGuardMu
+type clientFailures struct {
+	failures    int
+	windowStart time.Time
+	bans        int
+	bannedUntil time.Time
+}
+
+var clientGuardMu sync.Mutex
+
+var clientFailuresCache = cache.NewCache[*clientFailures](&cache.CacheConfig{
+	Name:     "guard:clientFailures",
+	Lifetime: clientFailuresLifetime,
+	MaxSize:  100000,
+})
+
+// GuardStats holds the counters of the client guard
+type GuardStats struct {
+	Failures int64 `json:"failures"`
+	Bans     int64 `json:"bans"`
+	Blocked  int64 `json:"blocked"`
+}
+
+var guardStats struct {
+	failures atomic.Int64
+	bans     atomic.Int64
+	blocked  atomic.Int64
+}
+
+func GetGuardStats() GuardStats {
+	return GuardStats{
+		Failures: guardStats.failures.Load(),
+		Bans:     guardStats.bans.Load(),
+		Blocked:  guardStats.blocked.Load(),
+	}
+}
+
+func banDuration(bans int) time.Duration {
+	d := config.ClientGuard.BanDuration
+	for i := 1; i < bans && d < config.ClientGuard.MaxBanDuration; i++ {
+		d *= 2
+	}
+	return min(d, config.ClientGuard.MaxBanDuration)
+}
+
+// RecordClientFailure counts a failed auth or token attempt from the client
+// of r, banning it once the failure limit is reached.
+func RecordClientFailure(r *http.Request, reason string) {
+	ip := server.GetReqCtx(r).ClientIP
+	if ip == "" {
+		return
+	}
+	guardStats.failures.Add(1)
+	if config.ClientGuard.FailureLimit == 0 {
+		return
+	}
+
+	clientGuardMu.Lock()
+	defer clientGuardMu.Unlock()
+
+	now := time.Now()
+	cf, ok := clientFailuresCache.Get(ip)
+	if !ok {
+		cf = &clientFailures{}
+	}
+	if now.Sub(cf.windowStart) > config.ClientGuard.FailureWindow {
+		cf.failures, cf.windowStart = 0, now
+	}
+	cf.failures++
+	if cf.failures >= config.ClientGuard.FailureLimit {
+		cf.failures = 0
+		cf.bans++
+		duration := banDuration(cf.bans)
+		cf.bannedUntil = now.Add(duration)
+		guardStats.bans.Add(1)
+		guardLog.Warn("client banned", "ip", ip, "reason", reason, "duration", duration, "bans", cf.bans)
+	}
+	clientFailuresCache.Set(ip, cf)
+}
+
+// clientBannedUntil returns when the ban of ip ends, zero when not banned
+func clientBannedUntil(ip string) time.Time {
+	clientGuardMu.Lock()
+	defer clientGuardMu.Unlock()
+
+	if cf, ok := clientFailuresCache.Get(ip); ok && time.Now().Before(cf.bannedUntil) {
+		return cf.bannedUntil
+	}
+	return time.Time{}
+}
+
+// GuardClient rejects requests from banned client ips
+func GuardClient(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := server.GetReqCtx(r).ClientIP
+		if ip == "" || config.ClientGuard.FailureLimit == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if until := clientBannedUntil(ip); !until.IsZero() {
+			guardStats.blocked.Add(1)
+			guardLog.Info("blocked request", "ip", ip, "path", r.URL.Path, "until", until)
+			retryAfter := int(time.Until(until).Seconds()) + 1
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			err := ErrorTooManyRequests(r)
+			err.Msg = "too many failed attempts, retry later"
+			err.Send(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,92 @@
+package shared
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Dydhzo/stremthru-proxy/internal/config"
+	"github.com/Dydhzo/stremthru-proxy/internal/server"
+	"github.com/stretchr/testify/suite"
+)
+
+type ClientGuardTestSuite struct {
+	suite.Suite
+	guard config.ClientGuardConfig
+}
+
+func (s *ClientGuardTestSuite) SetupTest() {
+	s.guard = config.ClientGuard
+	config.ClientGuard = config.ClientGuardConfig{
+		FailureLimit:   3,
+		FailureWindow:  time.Minute,
+		BanDuration:    time.Minute,
+		MaxBanDuration: 3 * time.Minute,
+	}
+}
+
+func (s *ClientGuardTestSuite) TearDownTest() {
+	config.ClientGuard = s.guard
+}
+
+func (s *ClientGuardTestSuite) request(ip string) *http.Request {
+	return server.SetReqCtx(httptest.NewRequest("GET", "/v0/proxy/token", nil), &server.ReqCtx{ClientIP: ip})
+}
+
+func (s *ClientGuardTestSuite) serve(ip string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	GuardClient(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})(w, s.request(ip))
+	return w
+}
+
+func (s *ClientGuardTestSuite) TestBan() {
+	ip := "192.0.2.1"
+	for range 2 {
+		RecordClientFailure(s.request(ip), "test")
+	}
+	s.Equal(http.StatusNoContent, s.serve(ip).Code)
+
+	blocked := GetGuardStats().Blocked
+	RecordClientFailure(s.request(ip), "test")
+	w := s.serve(ip)
+	s.Equal(http.StatusTooManyRequests, w.Code)
+	s.NotEmpty(w.Header().Get("Retry-After"))
+	s.Equal(blocked+1, GetGuardStats().Blocked)
+
+	s.Equal(http.StatusNoContent, s.serve("192.0.2.2").Code, "other clients are not banned")
+}
+
+func (s *ClientGuardTestSuite) TestDisabled() {
+	config.ClientGuard.FailureLimit = 0
+	ip := "192.0.2.3"
+	for range 5 {
+		RecordClientFailure(s.request(ip), "test")
+	}
+	s.Equal(http.StatusNoContent, s.serve(ip).Code)
+}
+
+func (s *ClientGuardTestSuite) TestBanDuration() {
+	s.Equal(time.Minute, banDuration(1))
+	s.Equal(2*time.Minute, banDuration(2))
+	s.Equal(3*time.Minute, banDuration(3), "capped at the max")
+	s.Equal(3*time.Minute, banDuration(10))
+}
+
+func (s *ClientGuardTestSuite) TestInvalidTokenCache() {
+	token := "invalid-token"
+	_, err := UnwrapProxyLinkToken(token)
+	s.Require().Error(err)
+	s.True(IsInvalidProxyLinkTokenError(err))
+
+	_, ok := invalidProxyLinkTokenCache.Get(token)
+	s.True(ok)
+	_, err = UnwrapProxyLinkToken(token)
+	s.True(IsInvalidProxyLinkTokenError(err))
+}
+
+func TestClientGuard(t *testing.T) {
+	suite.Run(t, new(ClientGuardTestSuite))
+}
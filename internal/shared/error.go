@@ -38,6 +38,22 @@ var ErrorMethodNotAllowed = func(r *http.Request) *core.APIError {
 	return err
 }
 
+var ErrorGone = func(r *http.Request) *core.APIError {
+	err := core.NewAPIError("gone")
+	err.InjectReq(r)
+	err.Code = core.ErrorCodeGone
+	err.StatusCode = http.StatusGone
+	return err
+}
+
+var ErrorTooManyRequests = func(r *http.Request) *core.APIError {
+	err := core.NewAPIError("too many requests")
+	err.InjectReq(r)
+	err.Code = core.ErrorCodeTooManyRequests
+	err.StatusCode = http.StatusTooManyRequests
+	return err
+}
+
 var ErrorUnsupportedMediaType = func(r *http.Request) *core.APIError {
 	err := core.NewAPIError("unsupported media type")
 	err.InjectReq(r)
@@ -46,6 +62,14 @@ var ErrorUnsupportedMediaType = func(r *http.Request) *core.APIError {
 	return err
 }
 
+var ErrorContentTooLarge = func(r *http.Request) *core.APIError {
+	err := core.NewAPIError("content too large")
+	err.InjectReq(r)
+	err.Code = core.ErrorCodeContentTooLarge
+	err.StatusCode = http.StatusRequestEntityTooLarge
+	return err
+}
+
 var ErrorProxyAuthRequired = func(r *http.Request) *core.APIError {
 	err := core.NewAPIError("proxy auth required")
 	err.InjectReq(r)
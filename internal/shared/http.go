@@ -2,6 +2,7 @@ package shared
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"io"
@@ -9,10 +10,14 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/Dydhzo/stremthru-proxy/core"
 	"github.com/Dydhzo/stremthru-proxy/internal/config"
 	"github.com/Dydhzo/stremthru-proxy/internal/server"
+	"github.com/Dydhzo/stremthru-proxy/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func IsMethod(r *http.Request, method string) bool {
@@ -50,7 +55,8 @@ func (res response) send(w http.ResponseWriter, r *http.Request, statusCode int)
 	}
 }
 
-func SendError(w http.ResponseWriter, r *http.Request, err error) {
+// PackError converts err into a packed *core.Error for the request
+func PackError(r *http.Request, err error) *core.Error {
 	var e core.StremThruError
 	if sterr, ok := err.(core.StremThruError); ok {
 		e = sterr
@@ -58,12 +64,17 @@ func SendError(w http.ResponseWriter, r *http.Request, err error) {
 		e = &core.Error{Cause: err}
 	}
 	e.Pack(r)
+	return e.GetError()
+}
+
+func SendError(w http.ResponseWriter, r *http.Request, err error) {
+	e := PackError(r, err)
 
 	ctx := server.GetReqCtx(r)
 	ctx.Error = err
 
 	res := &response{}
-	res.Error = e.GetError()
+	res.Error = e
 
 	res.send(w, r, e.GetStatusCode())
 }
@@ -87,67 +98,320 @@ func SendHTML(w http.ResponseWriter, statusCode int, data bytes.Buffer) {
 }
 
 
+// Headers identifying the client, dropped when the client ip is not meant to reach upstream.
+var clientIpHeaders = []string{
+	"Cf-Connecting-Ip",
+	"Cf-Pseudo-Ipv4",
+	"Do-Connecting-Ip",
+	"Fastly-Client-Ip",
+	"Forwarded",
+	"Forwarded-For",
+	"True-Client-Ip",
+	"X-Appengine-User-Ip",
+	"X-Client-Ip",
+	"X-Cluster-Client-Ip",
+	"X-Forwarded",
+	"X-Forwarded-For",
+	"X-Real-Ip",
+}
+
+// Our own credentials, never forwarded upstream.
+var proxyAuthHeaders = []string{
+	server.HEADER_PROXY_AUTHORIZATION,
+	server.HEADER_STREMTHRU_AUTHORIZATION,
+}
+
 func copyHeaders(src http.Header, dest http.Header, stripIpHeaders bool) {
-	for key, values := range src {
-		if stripIpHeaders {
-			switch strings.ToLower(key) {
-			case "x-client-ip", "x-forwarded-for", "cf-connecting-ip", "do-connecting-ip", "fastly-client-ip", "true-client-ip", "x-real-ip", "x-cluster-client-ip", "x-forwarded", "forwarded-for", "forwarded", "x-appengine-user-ip", "cf-pseudo-ipv4":
-				continue
-			}
+	src = src.Clone()
+	config.RemoveHopByHopHeaders(src)
+	if stripIpHeaders {
+		for _, key := range clientIpHeaders {
+			src.Del(key)
 		}
+	}
+	for key, values := range src {
 		for _, value := range values {
 			dest.Add(key, value)
 		}
 	}
 }
 
+func copyRequestHeaders(src http.Header, dest http.Header) {
+	copyHeaders(src, dest, true)
+	for _, key := range proxyAuthHeaders {
+		dest.Del(key)
+	}
+	for key := range dest {
+		if !config.ProxyForwardHeaders.IsAllowed(key) {
+			dest.Del(key)
+		}
+	}
+}
+
+// Redirects are handled by ProxyResponse, so the policy can be applied per hop.
+func noFollowRedirect(req *http.Request, via []*http.Request) error {
+	return http.ErrUseLastResponse
+}
+
 var proxyHttpClientByTunnelType = map[config.TunnelType]*http.Client{
 	config.TUNNEL_TYPE_NONE: func() *http.Client {
 		transport := config.DefaultHTTPTransport.Clone()
 		transport.Proxy = config.Tunnel.GetProxy(config.TUNNEL_TYPE_NONE)
 		return &http.Client{
-			Transport: transport,
+			Transport:     config.SSRF.Transport(transport),
+			CheckRedirect: noFollowRedirect,
 		}
 	}(),
 	config.TUNNEL_TYPE_AUTO: func() *http.Client {
 		transport := config.DefaultHTTPTransport.Clone()
 		transport.Proxy = config.Tunnel.GetProxy(config.TUNNEL_TYPE_AUTO)
 		return &http.Client{
-			Transport: transport,
+			Transport:     config.SSRF.Transport(transport),
+			CheckRedirect: noFollowRedirect,
 		}
 	}(),
 	config.TUNNEL_TYPE_FORCED: func() *http.Client {
 		transport := config.DefaultHTTPTransport.Clone()
 		transport.Proxy = config.Tunnel.GetProxy(config.TUNNEL_TYPE_FORCED)
 		return &http.Client{
-			Transport: transport,
+			Transport:     config.SSRF.Transport(transport),
+			CheckRedirect: noFollowRedirect,
 		}
 	}(),
 }
 
-func ProxyResponse(w http.ResponseWriter, r *http.Request, url string, tunnelType config.TunnelType) (bytesWritten int64, err error) {
-	request, err := http.NewRequest(r.Method, url, nil)
+func isRedirectStatus(statusCode int) bool {
+	switch statusCode {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+// Same rule as net/http: credentials only follow a redirect to the same
+// host or one of its subdomains.
+func isSameOrSubdomain(initialHost, destHost string) bool {
+	if initialHost == destHost {
+		return true
+	}
+	return strings.HasSuffix(destHost, "."+initialHost)
+}
+
+func newUpstreamRequest(r *http.Request, link *ProxyLink, method string, body io.Reader, upstreamUrl *url.URL, initialUrl *url.URL) (*http.Request, error) {
+	request, err := http.NewRequest(method, upstreamUrl.String(), body)
 	if err != nil {
-		e := ErrorInternalServerError(r, "failed to create request")
-		e.Cause = err
-		SendError(w, r, e)
+		return nil, err
+	}
+
+	// only the upstream url of the link is requested, the client query
+	// string (which may hold the token) is never forwarded
+	copyRequestHeaders(r.Header, request.Header)
+	if body == nil {
+		request.Header.Del("Content-Type")
+		request.Header.Del("Content-Length")
+	} else {
+		// -1 when the client sent the body chunked
+		request.ContentLength = r.ContentLength
+	}
+
+	if isSameOrSubdomain(initialUrl.Hostname(), upstreamUrl.Hostname()) {
+		for k, v := range link.Headers {
+			request.Header.Set(k, v)
+		}
+	} else {
+		for _, key := range []string{"Authorization", "Cookie", "Cookie2", "Www-Authenticate"} {
+			request.Header.Del(key)
+		}
+	}
+
+	addUpstreamHeaders(r, request, config.ProxyUpstreamHeaders.Get(upstreamUrl.Hostname()))
+
+	return request, nil
+}
+
+// RFC 7239 node, ipv6 addresses are bracketed and quoted.
+func formatForwardedNode(ip string) string {
+	if strings.Contains(ip, ":") {
+		return `"[` + ip + `]"`
+	}
+	return ip
+}
+
+func addUpstreamHeaders(r *http.Request, request *http.Request, rules *config.UpstreamHeaderRules) {
+	if rules == nil {
 		return
 	}
+	if rules.Via {
+		version := strconv.Itoa(r.ProtoMajor)
+		if r.ProtoMajor < 2 {
+			version += "." + strconv.Itoa(r.ProtoMinor)
+		}
+		request.Header.Add("Via", version+" stremthru")
+	}
+	if rules.Forwarded {
+		request.Header.Set("Forwarded", "for="+formatForwardedNode(server.GetReqCtx(r).ClientIP)+";proto="+ExtractRequestBaseURL(r).Scheme)
+	}
+	for k, v := range rules.Set {
+		request.Header.Set(k, v)
+	}
+}
 
-	copyHeaders(r.Header, request.Header, true)
+func redactUrl(u *url.URL) string {
+	return (&url.URL{Scheme: u.Scheme, Host: u.Host, Path: u.Path}).String()
+}
 
-	proxyHttpClient := proxyHttpClientByTunnelType[tunnelType]
+func ProxyResponse(w http.ResponseWriter, r *http.Request, link *ProxyLink) (bytesWritten int64, err error) {
+	ctx := server.GetReqCtx(r)
 
-	response, err := proxyHttpClient.Do(request)
+	initialUrl, err := url.Parse(link.URL)
 	if err != nil {
-		e := ErrorBadGateway(r, "failed to request url")
+		e := ErrorInternalServerError(r, "failed to create request")
 		e.Cause = err
 		SendError(w, r, e)
 		return
 	}
+
+	proxyHttpClient := proxyHttpClientByTunnelType[link.TunnelType]
+	proxy := config.Tunnel.GetProxy(link.TunnelType)
+
+	// the body is streamed, it can only be sent once
+	method := r.Method
+	var body io.Reader
+	if method != http.MethodGet && method != http.MethodHead && r.ContentLength != 0 {
+		if r.ContentLength > config.ProxyMaxBodySize {
+			e := ErrorContentTooLarge(r)
+			SendError(w, r, e)
+			return 0, e
+		}
+		body = http.MaxBytesReader(w, r.Body, config.ProxyMaxBodySize)
+	}
+
+	upstreamUrl := initialUrl
+	var response *http.Response
+	for hop := 0; ; hop++ {
+		request, err := newUpstreamRequest(r, link, method, body, upstreamUrl, initialUrl)
+		if err != nil {
+			e := ErrorInternalServerError(r, "failed to create request")
+			e.Cause = err
+			SendError(w, r, e)
+			return 0, err
+		}
+
+		// tunnel rules are evaluated against each hop's own host
+		_, tunnelSpan := tracing.Start(r.Context(), "proxy.tunnel")
+		tunnelHost := ""
+		if proxy != nil {
+			if proxyUrl, _ := proxy(request); proxyUrl != nil {
+				tunnelHost = proxyUrl.Host
+			}
+		}
+		tunnelSpan.SetAttributes(attribute.String("stremthru.tunnel.type", link.TunnelType.Name()), attribute.String("stremthru.tunnel.host", tunnelHost))
+		tunnelSpan.End()
+		ctx.Log.Debug("[proxy] upstream request", "hop", hop, "method", method, "host", upstreamUrl.Host, "tunnel", tunnelHost)
+		ctx.UpstreamHost = upstreamUrl.Host
+
+		// the tunnel resolves the host itself, so the dialer can not guard it
+		if tunnelHost != "" {
+			if err := config.SSRF.CheckURL(r.Context(), upstreamUrl); err != nil {
+				e := ErrorForbidden(r)
+				e.Msg = err.Error()
+				e.Cause = err
+				SendError(w, r, e)
+				return 0, err
+			}
+		}
+
+		// the upstream request outlives the client one, as before tracing
+		upstreamCtx, upstreamSpan := tracing.Start(r.Context(), "proxy.upstream", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+			attribute.String("http.request.method", method),
+			attribute.String("server.address", upstreamUrl.Host),
+			attribute.Int("http.request.resend_count", hop),
+		))
+		response, err = proxyHttpClient.Do(tracing.WithClientTrace(context.WithoutCancel(upstreamCtx), request))
+		if response != nil {
+			upstreamSpan.SetAttributes(attribute.Int("http.response.status_code", response.StatusCode))
+		}
+		tracing.End(upstreamSpan, err)
+		if err != nil {
+			if maxBytesErr := (*http.MaxBytesError)(nil); errors.As(err, &maxBytesErr) {
+				e := ErrorContentTooLarge(r)
+				e.Cause = err
+				SendError(w, r, e)
+				return 0, err
+			}
+			if errors.Is(err, config.ErrSSRFBlocked) {
+				e := ErrorForbidden(r)
+				e.Msg = config.ErrSSRFBlocked.Error()
+				e.Cause = err
+				SendError(w, r, e)
+				return 0, err
+			}
+			e := ErrorBadGateway(r, "failed to request url")
+			e.Cause = err
+			SendError(w, r, e)
+			return 0, err
+		}
+
+		if !isRedirectStatus(response.StatusCode) {
+			break
+		}
+		location, err := response.Location()
+		if err != nil {
+			// nothing to follow, hand the response over as is
+			break
+		}
+		response.Body.Close()
+
+		// a redirect link would be another use, usage limited links follow instead
+		policy := config.ProxyRedirectPolicy
+		if policy == config.REDIRECT_POLICY_PASSTHROUGH && link.Constraints.hasUsageLimits() {
+			policy = config.REDIRECT_POLICY_FOLLOW
+		}
+		switch policy {
+		case config.REDIRECT_POLICY_REJECT:
+			e := ErrorBadGateway(r, "upstream redirect rejected")
+			SendError(w, r, e)
+			return 0, e
+		case config.REDIRECT_POLICY_PASSTHROUGH:
+			redirectLink, err := createRedirectProxyLink(r, link, location)
+			if err != nil {
+				SendError(w, r, err)
+				return 0, err
+			}
+			ctx.Log.Info("[proxy] passing redirect through", "status", response.StatusCode, "location", redactUrl(location))
+			w.Header().Set("Location", redirectLink)
+			w.WriteHeader(response.StatusCode)
+			return 0, nil
+		}
+
+		if hop+1 > config.ProxyMaxRedirects {
+			e := ErrorBadGateway(r, "too many upstream redirects")
+			SendError(w, r, e)
+			return 0, e
+		}
+		switch response.StatusCode {
+		case http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+			if body != nil {
+				e := ErrorBadGateway(r, "can not resend request body on upstream redirect")
+				SendError(w, r, e)
+				return 0, e
+			}
+		default:
+			// same as net/http, 301, 302 and 303 continue with a GET
+			if method != http.MethodGet && method != http.MethodHead {
+				method, body = http.MethodGet, nil
+			}
+		}
+		upstreamUrl = location
+	}
 	defer response.Body.Close()
 
+	if upstreamUrl != initialUrl {
+		ctx.Log.Info("[proxy] followed redirect", "final_url", redactUrl(upstreamUrl))
+	}
+
 	copyHeaders(response.Header, w.Header(), false)
+	link.ResponseHeaders.Merge(config.ProxyResponseHeaders).Apply(w.Header(), r.PathValue("filename"))
 
 	w.WriteHeader(response.StatusCode)
 
@@ -160,42 +424,82 @@ func ProxyResponse(w http.ResponseWriter, r *http.Request, url string, tunnelTyp
 		addBytes = statsHandler.AddBytes
 	}
 
+	_, streamSpan := tracing.Start(r.Context(), "proxy.stream")
 	monitoredWriter := NewMonitoredWriter(w, addBytes)
-	return io.Copy(monitoredWriter, response.Body)
+	bytesWritten, err = io.Copy(monitoredWriter, response.Body)
+	streamSpan.SetAttributes(attribute.Int64("http.response.body.size", bytesWritten))
+	tracing.End(streamSpan, err)
+	return bytesWritten, err
 }
 
-func extractRequestScheme(r *http.Request) string {
-	scheme := r.Header.Get("X-Forwarded-Proto")
-
-	if scheme == "" {
-		scheme = r.URL.Scheme
-	}
+// UpstreamProbe is what a HEAD request reports about an upstream url
+type UpstreamProbe struct {
+	StatusCode    int
+	ContentType   string
+	ContentLength int64
+}
 
-	if scheme == "" {
-		scheme = "http"
-		if r.TLS != nil {
-			scheme = "https"
+// ProbeUpstream sends a HEAD request for link, following redirects up to
+// the configured limit.
+func ProbeUpstream(ctx context.Context, link string, headers map[string]string, tunnelType config.TunnelType) (*UpstreamProbe, error) {
+	client := *proxyHttpClientByTunnelType[tunnelType]
+	client.Timeout = 15 * time.Second
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if config.ProxyRedirectPolicy == config.REDIRECT_POLICY_REJECT {
+			return errors.New("upstream redirect rejected")
 		}
+		if len(via) > config.ProxyMaxRedirects {
+			return errors.New("too many upstream redirects")
+		}
+		return nil
 	}
 
-	return scheme
-}
-
-func extractRequestHost(r *http.Request) string {
-	host := r.Header.Get("X-Forwarded-Host")
+	request, err := http.NewRequestWithContext(ctx, http.MethodHead, link, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range headers {
+		request.Header.Set(k, v)
+	}
 
-	if host == "" {
-		host = r.Host
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, err
 	}
+	response.Body.Close()
 
-	return host
+	return &UpstreamProbe{
+		StatusCode:    response.StatusCode,
+		ContentType:   response.Header.Get("Content-Type"),
+		ContentLength: response.ContentLength,
+	}, nil
 }
 
-
+// ExtractRequestBaseURL returns the public base url, path prefix included,
+// the request was sent to. STREMTHRU_BASE_URL_BY_HOST is looked up by request
+// host, forwarded headers are only honoured from trusted proxies, and
+// STREMTHRU_BASE_URL is used otherwise, or the request host when it is unset.
 func ExtractRequestBaseURL(r *http.Request) *url.URL {
-	return &url.URL{
-		Scheme: extractRequestScheme(r),
-		Host:   extractRequestHost(r),
+	info := config.TrustedProxy.GetForwarded(r)
+
+	host := r.Host
+	if info != nil && info.Host != "" {
+		host = info.Host
+	}
+	if config.PublicBaseURL.Has(host) {
+		return config.PublicBaseURL.Get(host)
+	}
+	// an explicit base url wins over the forwarded host and scheme
+	if config.IsBaseURLConfigured {
+		return config.PublicBaseURL.Get("*")
 	}
-}
 
+	baseUrl := &url.URL{Scheme: "http", Host: host}
+	if r.TLS != nil {
+		baseUrl.Scheme = "https"
+	}
+	if info != nil && (info.Proto == "http" || info.Proto == "https") {
+		baseUrl.Scheme = info.Proto
+	}
+	return baseUrl
+}
@@ -0,0 +1,437 @@
+package shared
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Dydhzo/stremthru-proxy/internal/config"
+	"github.com/Dydhzo/stremthru-proxy/internal/server"
+	"github.com/rs/xid"
+	"github.com/stretchr/testify/suite"
+)
+
+type BaseURLTestSuite struct {
+	suite.Suite
+	configured   bool
+	baseURL      config.BaseURLMap
+	trustedProxy config.TrustedProxies
+}
+
+func (s *BaseURLTestSuite) SetupTest() {
+	s.configured, s.baseURL, s.trustedProxy = config.IsBaseURLConfigured, config.PublicBaseURL, config.TrustedProxy
+	config.PublicBaseURL = config.BaseURLMap{"*": &url.URL{Scheme: "https", Host: "stremthru.example.com"}}
+	// the peer of httptest requests
+	config.TrustedProxy = config.TrustedProxies{netip.MustParsePrefix("192.0.2.1/32")}
+}
+
+func (s *BaseURLTestSuite) TearDownTest() {
+	config.IsBaseURLConfigured, config.PublicBaseURL, config.TrustedProxy = s.configured, s.baseURL, s.trustedProxy
+}
+
+func (s *BaseURLTestSuite) forwarded() *http.Request {
+	r := httptest.NewRequest("GET", "/v0/proxy", nil)
+	r.Host = "stremthru:8080"
+	r.Header.Set("X-Forwarded-Host", "media.example.com")
+	r.Header.Set("X-Forwarded-Proto", "https")
+	return r
+}
+
+func (s *BaseURLTestSuite) TestUnconfigured() {
+	config.IsBaseURLConfigured = false
+	r := httptest.NewRequest("GET", "/v0/proxy", nil)
+	r.Host = "media.example.com:9000"
+	s.Equal("http://media.example.com:9000", ExtractRequestBaseURL(r).String())
+}
+
+func (s *BaseURLTestSuite) TestConfigured() {
+	config.IsBaseURLConfigured = true
+	r := httptest.NewRequest("GET", "/v0/proxy", nil)
+	r.Host = "media.example.com:9000"
+	s.Equal("https://stremthru.example.com", ExtractRequestBaseURL(r).String())
+}
+
+func (s *BaseURLTestSuite) TestForwarded() {
+	config.IsBaseURLConfigured = false
+	s.Equal("https://media.example.com", ExtractRequestBaseURL(s.forwarded()).String())
+}
+
+func (s *BaseURLTestSuite) TestForwardedConfigured() {
+	config.IsBaseURLConfigured = true
+	config.PublicBaseURL["*"] = &url.URL{Scheme: "http", Host: "stremthru.example.com", Path: "/st"}
+	s.Equal("http://stremthru.example.com/st", ExtractRequestBaseURL(s.forwarded()).String(), "the configured base url wins")
+
+	config.PublicBaseURL["media.example.com"] = &url.URL{Scheme: "https", Host: "media.example.com", Path: "/media"}
+	s.Equal("https://media.example.com/media", ExtractRequestBaseURL(s.forwarded()).String(), "base urls by host match the forwarded host")
+}
+
+func TestBaseURL(t *testing.T) {
+	suite.Run(t, new(BaseURLTestSuite))
+}
+
+// upstreamRequest is what an upstream test server received
+type upstreamRequest struct {
+	Method string
+	Path   string
+	Header http.Header
+	Body   string
+}
+
+// testUpstream records the requests it receives and answers them with the
+// handler of their path, 200 "ok" by default
+type testUpstream struct {
+	*httptest.Server
+	mu       sync.Mutex
+	requests []upstreamRequest
+	handlers map[string]http.HandlerFunc
+}
+
+func newTestUpstream() *testUpstream {
+	u := &testUpstream{handlers: map[string]http.HandlerFunc{}}
+	u.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		u.mu.Lock()
+		u.requests = append(u.requests, upstreamRequest{Method: r.Method, Path: r.URL.Path, Header: r.Header.Clone(), Body: string(body)})
+		handler := u.handlers[r.URL.Path]
+		u.mu.Unlock()
+		if handler == nil {
+			w.Write([]byte("ok"))
+			return
+		}
+		handler(w, r)
+	}))
+	return u
+}
+
+func (u *testUpstream) redirect(path, location string, status int) {
+	u.handlers[path] = func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, location, status)
+	}
+}
+
+func (u *testUpstream) reset() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.requests = nil
+}
+
+func (u *testUpstream) received() []upstreamRequest {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return append([]upstreamRequest{}, u.requests...)
+}
+
+type ProxyResponseTestSuite struct {
+	suite.Suite
+	clients      map[config.TunnelType]*http.Client
+	policy       config.RedirectPolicy
+	maxRedirects int
+	upstream     *testUpstream
+}
+
+// useUnguardedProxyClients swaps the proxy clients for ones reaching
+// loopback upstreams, which the SSRF guard blocks, returning the previous ones
+func useUnguardedProxyClients() map[config.TunnelType]*http.Client {
+	clients := proxyHttpClientByTunnelType
+	client := &http.Client{Transport: http.DefaultTransport.(*http.Transport).Clone(), CheckRedirect: noFollowRedirect}
+	proxyHttpClientByTunnelType = map[config.TunnelType]*http.Client{
+		config.TUNNEL_TYPE_NONE:   client,
+		config.TUNNEL_TYPE_AUTO:   client,
+		config.TUNNEL_TYPE_FORCED: client,
+	}
+	return clients
+}
+
+func (s *ProxyResponseTestSuite) SetupSuite() {
+	s.clients = useUnguardedProxyClients()
+	config.ProxyAuth["upstream"] = "pass"
+}
+
+func (s *ProxyResponseTestSuite) TearDownSuite() {
+	proxyHttpClientByTunnelType = s.clients
+	delete(config.ProxyAuth, "upstream")
+}
+
+func (s *ProxyResponseTestSuite) SetupTest() {
+	s.policy, s.maxRedirects = config.ProxyRedirectPolicy, config.ProxyMaxRedirects
+	config.ProxyRedirectPolicy = config.REDIRECT_POLICY_FOLLOW
+	s.upstream = newTestUpstream()
+}
+
+func (s *ProxyResponseTestSuite) TearDownTest() {
+	config.ProxyRedirectPolicy, config.ProxyMaxRedirects = s.policy, s.maxRedirects
+	s.upstream.Close()
+}
+
+func (s *ProxyResponseTestSuite) link(path string) *ProxyLink {
+	return &ProxyLink{User: "upstream", URL: s.upstream.URL + path, TunnelType: config.TUNNEL_TYPE_NONE}
+}
+
+func (s *ProxyResponseTestSuite) request(method string, body io.Reader) *http.Request {
+	r := httptest.NewRequest(method, "/v0/proxy/token", body)
+	return server.SetReqCtx(r, &server.ReqCtx{StartTime: time.Now(), Log: slog.Default()})
+}
+
+func (s *ProxyResponseTestSuite) serve(r *http.Request, link *ProxyLink) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	ProxyResponse(w, r, link)
+	return w
+}
+
+func (s *ProxyResponseTestSuite) paths() []string {
+	paths := []string{}
+	for _, req := range s.upstream.received() {
+		paths = append(paths, req.Path)
+	}
+	return paths
+}
+
+func (s *ProxyResponseTestSuite) TestFollow() {
+	s.upstream.redirect("/start", "/middle", http.StatusFound)
+	s.upstream.redirect("/middle", "/end", http.StatusMovedPermanently)
+
+	w := s.serve(s.request("GET", nil), s.link("/start"))
+	s.Equal(http.StatusOK, w.Code)
+	s.Equal("ok", w.Body.String())
+	s.Equal([]string{"/start", "/middle", "/end"}, s.paths())
+}
+
+func (s *ProxyResponseTestSuite) TestMaxRedirects() {
+	config.ProxyMaxRedirects = 2
+	s.upstream.redirect("/loop", "/loop", http.StatusFound)
+
+	w := s.serve(s.request("GET", nil), s.link("/loop"))
+	s.Equal(http.StatusBadGateway, w.Code)
+	s.Contains(w.Body.String(), "too many upstream redirects")
+	s.Len(s.upstream.received(), 3, "the first request and 2 redirects")
+}
+
+func (s *ProxyResponseTestSuite) TestReject() {
+	config.ProxyRedirectPolicy = config.REDIRECT_POLICY_REJECT
+	s.upstream.redirect("/start", "/end", http.StatusFound)
+
+	w := s.serve(s.request("GET", nil), s.link("/start"))
+	s.Equal(http.StatusBadGateway, w.Code)
+	s.Contains(w.Body.String(), "upstream redirect rejected")
+	s.Equal([]string{"/start"}, s.paths())
+}
+
+func (s *ProxyResponseTestSuite) TestPassthrough() {
+	config.ProxyRedirectPolicy = config.REDIRECT_POLICY_PASSTHROUGH
+	s.upstream.redirect("/start", "https://1.1.1.1/next", http.StatusTemporaryRedirect)
+
+	link := s.link("/start")
+	link.ID = xid.New().String()
+	link.Headers = map[string]string{"X-Secret": "secret"}
+	w := s.serve(s.request("GET", nil), link)
+	s.Equal(http.StatusTemporaryRedirect, w.Code)
+	s.Equal([]string{"/start"}, s.paths(), "the redirect is not followed")
+
+	location, err := url.Parse(w.Header().Get("Location"))
+	s.Require().NoError(err)
+	s.True(strings.HasPrefix(location.Path, "/v0/proxy/"))
+	redirectLink, err := UnwrapProxyLinkToken(strings.TrimPrefix(location.Path, "/v0/proxy/"))
+	s.Require().NoError(err)
+	s.Equal("https://1.1.1.1/next", redirectLink.URL)
+	s.Equal("upstream", redirectLink.User)
+	s.Equal(link.ID, redirectLink.ID, "revoking the link revokes its redirects")
+	s.Empty(redirectLink.Headers, "link headers are not carried to another host")
+}
+
+func (s *ProxyResponseTestSuite) TestPassthroughUsageLimits() {
+	config.ProxyRedirectPolicy = config.REDIRECT_POLICY_PASSTHROUGH
+	s.upstream.redirect("/start", "/end", http.StatusFound)
+
+	link := s.link("/start")
+	link.Constraints = &ProxyLinkConstraints{MaxUses: 1}
+	w := s.serve(s.request("GET", nil), link)
+	s.Equal(http.StatusOK, w.Code)
+	s.Empty(w.Header().Get("Location"))
+	s.Equal([]string{"/start", "/end"}, s.paths(), "the redirect is followed")
+}
+
+func (s *ProxyResponseTestSuite) TestRedirectMethod() {
+	for _, tc := range []struct {
+		status int
+		method string
+		want   string
+	}{
+		{http.StatusSeeOther, "POST", "GET"},
+		{http.StatusSeeOther, "PUT", "GET"},
+		{http.StatusFound, "POST", "GET"},
+		{http.StatusMovedPermanently, "POST", "GET"},
+		{http.StatusTemporaryRedirect, "DELETE", "DELETE"},
+		{http.StatusSeeOther, "HEAD", "HEAD"},
+	} {
+		s.Run(http.StatusText(tc.status)+" "+tc.method, func() {
+			s.upstream.reset()
+			s.upstream.redirect("/start", "/end", tc.status)
+
+			r := s.request(tc.method, nil)
+			if tc.method != "HEAD" && tc.method != "DELETE" {
+				r = s.request(tc.method, strings.NewReader("payload"))
+				r.Header.Set("Content-Type", "text/plain")
+			}
+			w := s.serve(r, s.link("/start"))
+			s.Equal(http.StatusOK, w.Code)
+
+			received := s.upstream.received()
+			s.Require().Len(received, 2)
+			end := received[1]
+			s.Equal(tc.want, end.Method)
+			if tc.want == "GET" {
+				s.Empty(end.Body, "the body is dropped")
+				s.Empty(end.Header.Get("Content-Type"))
+			}
+		})
+	}
+}
+
+func (s *ProxyResponseTestSuite) TestRedirectBodyNotResent() {
+	s.upstream.redirect("/start", "/end", http.StatusPermanentRedirect)
+
+	w := s.serve(s.request("POST", strings.NewReader("payload")), s.link("/start"))
+	s.Equal(http.StatusBadGateway, w.Code)
+	s.Contains(w.Body.String(), "can not resend request body")
+	s.Equal([]string{"/start"}, s.paths())
+}
+
+func (s *ProxyResponseTestSuite) TestCrossHostHeaders() {
+	other := newTestUpstream()
+	defer other.Close()
+	otherURL, err := url.Parse(other.URL)
+	s.Require().NoError(err)
+
+	// same address, but another hostname than the link
+	s.upstream.redirect("/start", "http://localhost:"+otherURL.Port()+"/end", http.StatusFound)
+	s.upstream.redirect("/same", "/end", http.StatusFound)
+
+	link := s.link("/start")
+	link.Headers = map[string]string{"X-Secret": "secret"}
+	w := s.serve(s.request("GET", nil), link)
+	s.Equal(http.StatusOK, w.Code)
+
+	s.Equal("secret", s.upstream.received()[0].Header.Get("X-Secret"))
+	s.Require().Len(other.received(), 1)
+	s.Empty(other.received()[0].Header.Get("X-Secret"), "link headers are dropped on another host")
+
+	link = s.link("/same")
+	link.Headers = map[string]string{"X-Secret": "secret"}
+	s.serve(s.request("GET", nil), link)
+	received := s.upstream.received()
+	s.Equal("/end", received[len(received)-1].Path)
+	s.Equal("secret", received[len(received)-1].Header.Get("X-Secret"), "link headers follow on the same host")
+}
+
+func (s *ProxyResponseTestSuite) TestBody() {
+	// a body of unknown length is streamed chunked
+	for name, body := range map[string]io.Reader{
+		"sized":   strings.NewReader("payload"),
+		"chunked": io.MultiReader(strings.NewReader("pay"), strings.NewReader("load")),
+	} {
+		s.upstream.reset()
+		r := s.request("POST", body)
+		r.Header.Set("Content-Type", "application/json")
+		w := s.serve(r, s.link("/end"))
+		s.Equal(http.StatusOK, w.Code, name)
+		received := s.upstream.received()
+		s.Require().Len(received, 1, name)
+		s.Equal("POST", received[0].Method, name)
+		s.Equal("payload", received[0].Body, name)
+		s.Equal("application/json", received[0].Header.Get("Content-Type"), name)
+	}
+}
+
+func (s *ProxyResponseTestSuite) TestBodyTooLarge() {
+	maxBodySize := config.ProxyMaxBodySize
+	defer func() { config.ProxyMaxBodySize = maxBodySize }()
+	config.ProxyMaxBodySize = 4
+
+	w := s.serve(s.request("POST", strings.NewReader("payload")), s.link("/end"))
+	s.Equal(http.StatusRequestEntityTooLarge, w.Code)
+	s.Empty(s.upstream.received())
+
+	// the length of a chunked body is only known while streaming it
+	w = s.serve(s.request("POST", io.MultiReader(strings.NewReader("pay"), strings.NewReader("load"))), s.link("/end"))
+	s.Equal(http.StatusRequestEntityTooLarge, w.Code)
+	for _, req := range s.upstream.received() {
+		s.NotEqual("payload", req.Body)
+	}
+}
+
+func TestProxyResponse(t *testing.T) {
+	suite.Run(t, new(ProxyResponseTestSuite))
+}
+
+type ProbeUpstreamTestSuite struct {
+	suite.Suite
+	clients  map[config.TunnelType]*http.Client
+	policy   config.RedirectPolicy
+	upstream *testUpstream
+}
+
+func (s *ProbeUpstreamTestSuite) SetupSuite() {
+	s.clients = useUnguardedProxyClients()
+}
+
+func (s *ProbeUpstreamTestSuite) TearDownSuite() {
+	proxyHttpClientByTunnelType = s.clients
+}
+
+func (s *ProbeUpstreamTestSuite) SetupTest() {
+	s.policy = config.ProxyRedirectPolicy
+	config.ProxyRedirectPolicy = config.REDIRECT_POLICY_FOLLOW
+	s.upstream = newTestUpstream()
+	s.upstream.redirect("/start", "/video.mp4", http.StatusFound)
+	s.upstream.handlers["/video.mp4"] = func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "video/mp4")
+		w.Header().Set("Content-Length", "1234")
+	}
+}
+
+func (s *ProbeUpstreamTestSuite) TearDownTest() {
+	config.ProxyRedirectPolicy = s.policy
+	s.upstream.Close()
+}
+
+func (s *ProbeUpstreamTestSuite) TestProbe() {
+	probe, err := ProbeUpstream(context.Background(), s.upstream.URL+"/start", map[string]string{"Referer": "https://example.com/"}, config.TUNNEL_TYPE_NONE)
+	s.Require().NoError(err)
+	s.Equal(http.StatusOK, probe.StatusCode)
+	s.Equal("video/mp4", probe.ContentType)
+	s.Equal(int64(1234), probe.ContentLength)
+
+	received := s.upstream.received()
+	s.Require().Len(received, 2)
+	for _, req := range received {
+		s.Equal("HEAD", req.Method)
+	}
+	s.Equal("https://example.com/", received[0].Header.Get("Referer"))
+}
+
+func (s *ProbeUpstreamTestSuite) TestRejectRedirect() {
+	config.ProxyRedirectPolicy = config.REDIRECT_POLICY_REJECT
+	_, err := ProbeUpstream(context.Background(), s.upstream.URL+"/start", nil, config.TUNNEL_TYPE_NONE)
+	s.ErrorContains(err, "upstream redirect rejected")
+}
+
+func (s *ProbeUpstreamTestSuite) TestTooManyRedirects() {
+	defer func(maxRedirects int) { config.ProxyMaxRedirects = maxRedirects }(config.ProxyMaxRedirects)
+	config.ProxyMaxRedirects = 2
+	s.upstream.redirect("/loop", "/loop", http.StatusFound)
+
+	_, err := ProbeUpstream(context.Background(), s.upstream.URL+"/loop", nil, config.TUNNEL_TYPE_NONE)
+	s.ErrorContains(err, "too many upstream redirects")
+}
+
+func TestProbeUpstream(t *testing.T) {
+	suite.Run(t, new(ProbeUpstreamTestSuite))
+}
@@ -0,0 +1,71 @@
+package shared
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Dydhzo/stremthru-proxy/core"
+	"github.com/Dydhzo/stremthru-proxy/internal/config"
+	"github.com/Dydhzo/stremthru-proxy/internal/server"
+	"github.com/stretchr/testify/suite"
+)
+
+type LinkExpiryPolicyTestSuite struct {
+	suite.Suite
+	policies config.LinkExpiryPolicyMap
+}
+
+func (s *LinkExpiryPolicyTestSuite) SetupTest() {
+	s.policies = config.ProxyLinkExpiry
+	config.ProxyLinkExpiry = config.LinkExpiryPolicyMap{
+		"*":      {Default: 6 * time.Hour, Max: 24 * time.Hour},
+		"strict": {Max: time.Hour, RequireExpiry: true},
+	}
+}
+
+func (s *LinkExpiryPolicyTestSuite) TearDownTest() {
+	config.ProxyLinkExpiry = s.policies
+}
+
+func (s *LinkExpiryPolicyTestSuite) request() *http.Request {
+	return server.SetReqCtx(httptest.NewRequest("GET", "/v0/proxy", nil), &server.ReqCtx{})
+}
+
+func (s *LinkExpiryPolicyTestSuite) TestApply() {
+	expiresIn, err := applyLinkExpiryPolicy(s.request(), "user", 0)
+	s.Require().NoError(err)
+	s.Equal(6*time.Hour, expiresIn)
+
+	expiresIn, err = applyLinkExpiryPolicy(s.request(), "user", time.Hour)
+	s.Require().NoError(err)
+	s.Equal(time.Hour, expiresIn)
+
+	_, err = applyLinkExpiryPolicy(s.request(), "user", 48*time.Hour)
+	s.Error(err)
+
+	expiresIn, err = applyLinkExpiryPolicy(s.request(), "strict", 0)
+	s.Require().NoError(err)
+	s.Equal(time.Hour, expiresIn)
+}
+
+func (s *LinkExpiryPolicyTestSuite) TestRequireExpiry() {
+	config.ProxyLinkExpiry["strict"] = config.LinkExpiryPolicy{RequireExpiry: true}
+
+	_, err := applyLinkExpiryPolicy(s.request(), "strict", 0)
+	s.Error(err)
+
+	_, err = CheckProxyLinkAccess(s.request(), &ProxyLink{User: "strict"})
+	s.Require().Error(err)
+	s.Equal(core.ErrorCodeForbidden, err.(*core.APIError).Code)
+
+	_, err = CheckProxyLinkAccess(s.request(), &ProxyLink{User: "strict", ExpiresAt: time.Now().Add(time.Hour)})
+	s.NoError(err)
+	_, err = CheckProxyLinkAccess(s.request(), &ProxyLink{User: "user"})
+	s.NoError(err)
+}
+
+func TestLinkExpiryPolicy(t *testing.T) {
+	suite.Run(t, new(LinkExpiryPolicyTestSuite))
+}
@@ -0,0 +1,344 @@
+package shared
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Dydhzo/stremthru-proxy/core"
+	"github.com/Dydhzo/stremthru-proxy/internal/config"
+	"github.com/Dydhzo/stremthru-proxy/internal/server"
+	"github.com/Dydhzo/stremthru-proxy/internal/store"
+)
+
+// ProxyLinkConstraints restrict when, from where and how often a link is served
+type ProxyLinkConstraints struct {
+	NotBefore time.Time `json:"nbf,omitzero"`
+	// Accesses served, HEAD requests, seeks and failed upstreams are not counted
+	MaxUses int `json:"maxu,omitempty"`
+	// Distinct client ips served
+	MaxIPs     int            `json:"maxip,omitempty"`
+	AllowedIPs []netip.Prefix `json:"ips,omitempty"`
+	// Hostname patterns the Origin or Referer must match, "*" matches any characters
+	AllowedReferers []string `json:"refs,omitempty"`
+}
+
+// hasUsageLimits reports whether c limits the uses or client ips of a link
+func (c *ProxyLinkConstraints) hasUsageLimits() bool {
+	return c != nil && (c.MaxUses != 0 || c.MaxIPs != 0)
+}
+
+func (c *ProxyLinkConstraints) IsZero() bool {
+	return c == nil || (c.NotBefore.IsZero() && c.MaxUses == 0 && c.MaxIPs == 0 && len(c.AllowedIPs) == 0 && len(c.AllowedReferers) == 0)
+}
+
+// ParseAllowedIPs parses comma separated or repeated ips and CIDRs
+func ParseAllowedIPs(values []string) ([]netip.Prefix, error) {
+	prefixes := []netip.Prefix{}
+	for _, value := range values {
+		for item := range strings.SplitSeq(value, ",") {
+			item = strings.TrimSpace(item)
+			if item == "" {
+				continue
+			}
+			if strings.Contains(item, "/") {
+				prefix, err := netip.ParsePrefix(item)
+				if err != nil {
+					return nil, errors.New("invalid allowed ip: " + item)
+				}
+				prefixes = append(prefixes, prefix.Masked())
+				continue
+			}
+			addr, err := netip.ParseAddr(item)
+			if err != nil {
+				return nil, errors.New("invalid allowed ip: " + item)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+		}
+	}
+	return prefixes, nil
+}
+
+// ParseAllowedReferers parses comma separated or repeated hostname patterns
+func ParseAllowedReferers(values []string) ([]string, error) {
+	patterns := []string{}
+	for _, value := range values {
+		for pattern := range strings.SplitSeq(value, ",") {
+			pattern = strings.ToLower(strings.TrimSpace(pattern))
+			if pattern == "" {
+				continue
+			}
+			if _, err := path.Match(pattern, ""); err != nil || strings.ContainsAny(pattern, "/:") {
+				return nil, errors.New("invalid allowed referer: " + pattern)
+			}
+			patterns = append(patterns, pattern)
+		}
+	}
+	return patterns, nil
+}
+
+// BindClientIP restricts c to the client ip of r, used for links bound to
+// the ip of their creator.
+func (c *ProxyLinkConstraints) BindClientIP(r *http.Request) error {
+	addr, err := netip.ParseAddr(server.GetReqCtx(r).ClientIP)
+	if err != nil {
+		return errors.New("unknown client ip")
+	}
+	addr = addr.Unmap()
+	c.AllowedIPs = append(c.AllowedIPs, netip.PrefixFrom(addr, addr.BitLen()))
+	return nil
+}
+
+func (c *ProxyLinkConstraints) validate(expiresAt time.Time) error {
+	if c.MaxUses < 0 || c.MaxIPs < 0 {
+		return errors.New("invalid max uses")
+	}
+	if !c.NotBefore.IsZero() && !expiresAt.IsZero() && !c.NotBefore.Before(expiresAt) {
+		return errors.New("not before must be before expiration")
+	}
+	return nil
+}
+
+func requestReferer(r *http.Request) string {
+	value := r.Header.Get("Origin")
+	if value == "" || value == "null" {
+		value = r.Header.Get("Referer")
+	}
+	if value == "" {
+		return ""
+	}
+	u, err := url.Parse(value)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Hostname())
+}
+
+func matchesReferer(patterns []string, host string) bool {
+	if host == "" {
+		return false
+	}
+	return slices.ContainsFunc(patterns, func(pattern string) bool {
+		ok, _ := path.Match(pattern, host)
+		return ok
+	})
+}
+
+// checkProxyLinkConstraints checks the request against the static
+// constraints of link, usage limits are checked by reserveProxyLinkUse.
+func checkProxyLinkConstraints(r *http.Request, link *ProxyLink) error {
+	c := link.Constraints
+	if !c.NotBefore.IsZero() && time.Now().Before(c.NotBefore) {
+		err := ErrorForbidden(r)
+		err.Msg = "proxy link not valid before " + c.NotBefore.UTC().Format(time.RFC3339)
+		return err
+	}
+	if len(c.AllowedIPs) > 0 {
+		addr, err := netip.ParseAddr(server.GetReqCtx(r).ClientIP)
+		if err != nil || !slices.ContainsFunc(c.AllowedIPs, func(prefix netip.Prefix) bool {
+			return prefix.Contains(addr.Unmap())
+		}) {
+			err := ErrorForbidden(r)
+			err.Msg = "proxy link not allowed from this ip"
+			return err
+		}
+	}
+	if len(c.AllowedReferers) > 0 && !matchesReferer(c.AllowedReferers, requestReferer(r)) {
+		err := ErrorForbidden(r)
+		err.Msg = "proxy link not allowed from this referer"
+		return err
+	}
+	return nil
+}
+
+const proxyLinkUsageBucket = "proxy_link_usage"
+
+// proxyLinkUsage counts the accesses of a link with usage limits
+type proxyLinkUsage struct {
+	Uses int `json:"uses"`
+	// keyed fingerprints of the client ips served
+	IPs       []string `json:"ips,omitempty"`
+	ExpiresAt int64    `json:"exp,omitempty"`
+}
+
+func sweepProxyLinkUsages(s *store.Store, now time.Time) (int, error) {
+	expired := []string{}
+	err := s.View(func(tx *store.Tx) error {
+		return tx.ForEach(proxyLinkUsageBucket, "", func(key string, value []byte) error {
+			usage := &proxyLinkUsage{}
+			if err := json.Unmarshal(value, usage); err == nil && usage.ExpiresAt != 0 && now.Unix() >= usage.ExpiresAt {
+				expired = append(expired, key)
+			}
+			return nil
+		})
+	})
+	if err != nil || len(expired) == 0 {
+		return 0, err
+	}
+	err = s.Update(func(tx *store.Tx) error {
+		for _, id := range expired {
+			if err := tx.Delete(proxyLinkUsageBucket, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return len(expired), err
+}
+
+// isProxyLinkUseStart reports whether r starts a new use of a link, a
+// request without Range or with a range starting at 0. Seeks and resumed
+// downloads continue a use.
+func isProxyLinkUseStart(r *http.Request) bool {
+	value := strings.TrimSpace(r.Header.Get("Range"))
+	return value == "" || strings.HasPrefix(value, "bytes=0-")
+}
+
+func hasProxyLinkUsageLimits(r *http.Request, link *ProxyLink) bool {
+	return link.Constraints.hasUsageLimits() && r.Method != http.MethodHead && link.ID != ""
+}
+
+func proxyLinkUsageIP(r *http.Request) string {
+	return base64.RawURLEncoding.EncodeToString(core.TokenSignature([]byte("ip:" + server.GetReqCtx(r).ClientIP)))
+}
+
+// ProxyLinkUse is the use and client ip of a link reserved for a request by
+// CheckProxyLinkAccess, so overlapping requests can not exceed the limits.
+type ProxyLinkUse struct {
+	link *ProxyLink
+	ip   string
+	// whether the request counted as a new use and as a new client ip
+	isUse bool
+	isIP  bool
+}
+
+// reserveProxyLinkUse fails once the usage limits of link are reached, and
+// otherwise counts r towards them. A client ip already served can still
+// continue its use past the use limit, and does not count as a new one.
+func reserveProxyLinkUse(r *http.Request, link *ProxyLink) (*ProxyLinkUse, error) {
+	if !hasProxyLinkUsageLimits(r, link) {
+		return nil, nil
+	}
+
+	s, err := getStore()
+	if err != nil {
+		e := ErrorInternalServerError(r, "proxy link usage unavailable")
+		e.Cause = err
+		return nil, e
+	}
+
+	use := &ProxyLinkUse{link: link, ip: proxyLinkUsageIP(r)}
+	isUseStart := isProxyLinkUseStart(r)
+	c := link.Constraints
+
+	err = s.Update(func(tx *store.Tx) error {
+		usage := &proxyLinkUsage{}
+		if value := tx.Get(proxyLinkUsageBucket, link.ID); value != nil {
+			if err := json.Unmarshal(value, usage); err != nil {
+				return err
+			}
+		}
+		isServed := slices.Contains(usage.IPs, use.ip)
+		if c.MaxUses != 0 && usage.Uses >= c.MaxUses && (isUseStart || !isServed) {
+			err := ErrorGone(r)
+			err.Msg = "proxy link use limit reached (" + strconv.Itoa(c.MaxUses) + ")"
+			return err
+		}
+		if c.MaxIPs != 0 && !isServed && len(usage.IPs) >= c.MaxIPs {
+			err := ErrorGone(r)
+			err.Msg = "proxy link client ip limit reached (" + strconv.Itoa(c.MaxIPs) + ")"
+			return err
+		}
+		if isServed && !isUseStart {
+			return nil
+		}
+		if !isServed {
+			usage.IPs = append(usage.IPs, use.ip)
+			use.isIP = true
+		}
+		if isUseStart {
+			usage.Uses++
+			use.isUse = true
+		}
+		if !link.ExpiresAt.IsZero() {
+			usage.ExpiresAt = link.ExpiresAt.Unix()
+		}
+		return putProxyLinkUsage(tx, link.ID, usage)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return use, nil
+}
+
+func putProxyLinkUsage(tx *store.Tx, id string, usage *proxyLinkUsage) error {
+	blob, err := json.Marshal(usage)
+	if err != nil {
+		return err
+	}
+	return tx.Put(proxyLinkUsageBucket, id, blob)
+}
+
+// Finish keeps the reserved use once the response w is sent, when the
+// upstream succeeded, and releases it otherwise.
+func (use *ProxyLinkUse) Finish(w http.ResponseWriter) {
+	if use == nil || (!use.isUse && !use.isIP) {
+		return
+	}
+	if rw, ok := w.(ResponseWriter); !ok || (rw.getStatusCode() >= 200 && rw.getStatusCode() < 300) {
+		return
+	}
+
+	s, err := getStore()
+	if err != nil {
+		proxyLinkLog.Error("failed to release link use", "id", use.link.ID, "error", err)
+		return
+	}
+
+	err = s.Update(func(tx *store.Tx) error {
+		value := tx.Get(proxyLinkUsageBucket, use.link.ID)
+		if value == nil {
+			return nil
+		}
+		usage := &proxyLinkUsage{}
+		if err := json.Unmarshal(value, usage); err != nil {
+			return err
+		}
+		if use.isUse && usage.Uses > 0 {
+			usage.Uses--
+		}
+		if use.isIP {
+			usage.IPs = slices.DeleteFunc(usage.IPs, func(ip string) bool { return ip == use.ip })
+		}
+		return putProxyLinkUsage(tx, use.link.ID, usage)
+	})
+	if err != nil {
+		proxyLinkLog.Error("failed to release link use", "id", use.link.ID, "error", err)
+	}
+}
+
+// CheckProxyLinkAccess enforces the expiry policy of the link user and the
+// constraints of link for r. The use it reserves, if any, must be finished
+// once the response is sent.
+func CheckProxyLinkAccess(r *http.Request, link *ProxyLink) (*ProxyLinkUse, error) {
+	if link.ExpiresAt.IsZero() && config.ProxyLinkExpiry.Get(link.User).RequireExpiry {
+		err := ErrorForbidden(r)
+		err.Msg = "proxy link without expiration not allowed, create a new link"
+		return nil, err
+	}
+	if link.Constraints.IsZero() {
+		return nil, nil
+	}
+	if err := checkProxyLinkConstraints(r, link); err != nil {
+		return nil, err
+	}
+	return reserveProxyLinkUse(r, link)
+}
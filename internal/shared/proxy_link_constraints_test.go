@@ -0,0 +1,215 @@
+package shared
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Dydhzo/stremthru-proxy/core"
+	"github.com/Dydhzo/stremthru-proxy/internal/config"
+	"github.com/Dydhzo/stremthru-proxy/internal/server"
+	"github.com/rs/xid"
+	"github.com/stretchr/testify/suite"
+)
+
+type ProxyLinkConstraintsTestSuite struct {
+	suite.Suite
+}
+
+func (s *ProxyLinkConstraintsTestSuite) request(method, ip string, headers map[string]string) *http.Request {
+	r := httptest.NewRequest(method, "/v0/proxy/token", nil)
+	for k, v := range headers {
+		r.Header.Set(k, v)
+	}
+	return server.SetReqCtx(r, &server.ReqCtx{ClientIP: ip})
+}
+
+func (s *ProxyLinkConstraintsTestSuite) errorCode(err error) core.ErrorCode {
+	if e, ok := err.(*core.APIError); ok {
+		return e.Code
+	}
+	return ""
+}
+
+func (s *ProxyLinkConstraintsTestSuite) TestParseAllowedIPs() {
+	prefixes, err := ParseAllowedIPs([]string{"203.0.113.7, 10.1.2.3/8", "::ffff:192.0.2.1"})
+	s.Require().NoError(err)
+	s.Equal([]netip.Prefix{
+		netip.MustParsePrefix("203.0.113.7/32"),
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("192.0.2.1/32"),
+	}, prefixes)
+
+	_, err = ParseAllowedIPs([]string{"example.com"})
+	s.Error(err)
+}
+
+func (s *ProxyLinkConstraintsTestSuite) TestParseAllowedReferers() {
+	patterns, err := ParseAllowedReferers([]string{"Example.com,*.example.com"})
+	s.Require().NoError(err)
+	s.Equal([]string{"example.com", "*.example.com"}, patterns)
+
+	_, err = ParseAllowedReferers([]string{"https://example.com"})
+	s.Error(err)
+}
+
+// check checks r against link, dropping the use it reserves
+func (s *ProxyLinkConstraintsTestSuite) check(r *http.Request, link *ProxyLink) error {
+	_, err := CheckProxyLinkAccess(r, link)
+	return err
+}
+
+// access checks r against link and, when allowed, finishes its use as
+// served upstream with status
+func (s *ProxyLinkConstraintsTestSuite) access(r *http.Request, link *ProxyLink, status int) error {
+	use, err := CheckProxyLinkAccess(r, link)
+	if err != nil {
+		return err
+	}
+	w := &responseWriter{ResponseWriter: httptest.NewRecorder()}
+	w.WriteHeader(status)
+	use.Finish(w)
+	return nil
+}
+
+func (s *ProxyLinkConstraintsTestSuite) TestNotBefore() {
+	link := &ProxyLink{Constraints: &ProxyLinkConstraints{NotBefore: time.Now().Add(time.Hour)}}
+	s.Equal(core.ErrorCodeForbidden, s.errorCode(s.check(s.request("GET", "203.0.113.7", nil), link)))
+
+	link.Constraints.NotBefore = time.Now().Add(-time.Second)
+	s.NoError(s.check(s.request("GET", "203.0.113.7", nil), link))
+}
+
+func (s *ProxyLinkConstraintsTestSuite) TestAllowedIPs() {
+	bound := &ProxyLinkConstraints{}
+	s.Require().NoError(bound.BindClientIP(s.request("GET", "203.0.113.7", nil)))
+	s.Equal([]netip.Prefix{netip.MustParsePrefix("203.0.113.7/32")}, bound.AllowedIPs)
+
+	link := &ProxyLink{Constraints: &ProxyLinkConstraints{AllowedIPs: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}}}
+	s.NoError(s.check(s.request("GET", "10.1.2.3", nil), link))
+	s.Equal(core.ErrorCodeForbidden, s.errorCode(s.check(s.request("GET", "203.0.113.7", nil), link)))
+	s.Equal(core.ErrorCodeForbidden, s.errorCode(s.check(s.request("GET", "", nil), link)))
+}
+
+func (s *ProxyLinkConstraintsTestSuite) TestAllowedReferers() {
+	link := &ProxyLink{Constraints: &ProxyLinkConstraints{AllowedReferers: []string{"example.com", "*.example.com"}}}
+	for _, tc := range []struct {
+		headers map[string]string
+		allowed bool
+	}{
+		{map[string]string{"Referer": "https://example.com/page"}, true},
+		{map[string]string{"Origin": "https://app.example.com"}, true},
+		{map[string]string{"Origin": "https://evil.com", "Referer": "https://example.com/page"}, false},
+		{map[string]string{"Referer": "https://example.com.evil.com/"}, false},
+		{nil, false},
+	} {
+		err := s.check(s.request("GET", "203.0.113.7", tc.headers), link)
+		if tc.allowed {
+			s.NoError(err, tc.headers)
+		} else {
+			s.Equal(core.ErrorCodeForbidden, s.errorCode(err), tc.headers)
+		}
+	}
+}
+
+func (s *ProxyLinkConstraintsTestSuite) TestMaxUses() {
+	link := &ProxyLink{ID: xid.New().String(), Constraints: &ProxyLinkConstraints{MaxUses: 2}}
+	s.NoError(s.access(s.request("GET", "203.0.113.7", nil), link, http.StatusOK))
+	s.NoError(s.access(s.request("HEAD", "203.0.113.7", nil), link, http.StatusOK))
+	s.NoError(s.access(s.request("GET", "203.0.113.7", nil), link, http.StatusOK))
+	s.Equal(core.ErrorCodeGone, s.errorCode(s.access(s.request("GET", "203.0.113.7", nil), link, http.StatusOK)))
+}
+
+func (s *ProxyLinkConstraintsTestSuite) TestMaxUsesRange() {
+	link := &ProxyLink{ID: xid.New().String(), Constraints: &ProxyLinkConstraints{MaxUses: 1}}
+	s.NoError(s.access(s.request("GET", "203.0.113.7", map[string]string{"Range": "bytes=0-"}), link, http.StatusPartialContent))
+
+	seek := map[string]string{"Range": "bytes=1000-"}
+	s.NoError(s.access(s.request("GET", "203.0.113.7", seek), link, http.StatusPartialContent), "seeks continue a use")
+	s.NoError(s.access(s.request("GET", "203.0.113.7", seek), link, http.StatusPartialContent))
+	s.Equal(core.ErrorCodeGone, s.errorCode(s.access(s.request("GET", "203.0.113.8", seek), link, http.StatusPartialContent)), "other clients can not seek past the limit")
+	s.Equal(core.ErrorCodeGone, s.errorCode(s.access(s.request("GET", "203.0.113.7", map[string]string{"Range": "bytes=0-99"}), link, http.StatusPartialContent)))
+}
+
+func (s *ProxyLinkConstraintsTestSuite) TestMaxUsesUpstreamFailure() {
+	link := &ProxyLink{ID: xid.New().String(), Constraints: &ProxyLinkConstraints{MaxUses: 1}}
+	s.NoError(s.access(s.request("GET", "203.0.113.7", nil), link, http.StatusBadGateway))
+	s.NoError(s.access(s.request("GET", "203.0.113.7", nil), link, http.StatusNotFound))
+	s.NoError(s.access(s.request("GET", "203.0.113.7", nil), link, http.StatusOK), "failed upstreams are not counted")
+	s.Equal(core.ErrorCodeGone, s.errorCode(s.access(s.request("GET", "203.0.113.7", nil), link, http.StatusOK)))
+}
+
+func (s *ProxyLinkConstraintsTestSuite) TestMaxUsesOverlapping() {
+	link := &ProxyLink{ID: xid.New().String(), Constraints: &ProxyLinkConstraints{MaxUses: 1, MaxIPs: 1}}
+	use, err := CheckProxyLinkAccess(s.request("GET", "203.0.113.7", nil), link)
+	s.Require().NoError(err)
+
+	// the first response is still streaming
+	s.Equal(core.ErrorCodeGone, s.errorCode(s.check(s.request("GET", "203.0.113.7", nil), link)))
+	s.Equal(core.ErrorCodeGone, s.errorCode(s.check(s.request("GET", "203.0.113.8", map[string]string{"Range": "bytes=1000-"}), link)))
+
+	w := &responseWriter{ResponseWriter: httptest.NewRecorder()}
+	w.WriteHeader(http.StatusBadGateway)
+	use.Finish(w)
+	s.NoError(s.access(s.request("GET", "203.0.113.8", nil), link, http.StatusOK), "failed uses are released")
+	s.Equal(core.ErrorCodeGone, s.errorCode(s.check(s.request("GET", "203.0.113.7", nil), link)))
+}
+
+func (s *ProxyLinkConstraintsTestSuite) TestMaxIPs() {
+	link := &ProxyLink{ID: xid.New().String(), ExpiresAt: time.Now().Add(time.Hour), Constraints: &ProxyLinkConstraints{MaxIPs: 1}}
+	s.NoError(s.access(s.request("GET", "203.0.113.7", nil), link, http.StatusOK))
+	s.NoError(s.access(s.request("GET", "203.0.113.7", nil), link, http.StatusOK))
+	s.Equal(core.ErrorCodeGone, s.errorCode(s.access(s.request("GET", "203.0.113.8", nil), link, http.StatusOK)))
+
+	st, err := getStore()
+	s.Require().NoError(err)
+	count, err := sweepProxyLinkUsages(st, time.Now().Add(2*time.Hour))
+	s.Require().NoError(err)
+	s.GreaterOrEqual(count, 1)
+}
+
+func (s *ProxyLinkConstraintsTestSuite) TestTokenRoundTrip() {
+	config.ProxyAuth["constraints"] = "pass"
+	defer delete(config.ProxyAuth, "constraints")
+
+	constraints := &ProxyLinkConstraints{
+		NotBefore:       time.Unix(time.Now().Unix()+60, 0).UTC(),
+		MaxUses:         3,
+		AllowedIPs:      []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+		AllowedReferers: []string{"*.example.com"},
+	}
+	for _, format := range []config.TokenFormat{config.TOKEN_FORMAT_COMPACT, config.TOKEN_FORMAT_LEGACY} {
+		for _, encrypted := range []bool{false, true} {
+			func() {
+				defer func(format config.TokenFormat) { config.ProxyTokenFormat = format }(config.ProxyTokenFormat)
+				config.ProxyTokenFormat = format
+
+				link := &ProxyLink{User: "constraints", URL: "https://1.1.1.1/video.mkv", Encrypted: encrypted, Constraints: constraints}
+				r := server.SetReqCtx(httptest.NewRequest("GET", "/v0/proxy", nil), &server.ReqCtx{})
+				proxyURL, err := CreateProxyLink(r, link, 0, "pass", "")
+				s.Require().NoError(err)
+
+				decoded, err := UnwrapProxyLinkToken(strings.TrimPrefix(proxyURL, "http://example.com/v0/proxy/"))
+				s.Require().NoError(err)
+				s.Equal(constraints, decoded.Constraints, format)
+			}()
+		}
+	}
+}
+
+func (s *ProxyLinkConstraintsTestSuite) TestValidate() {
+	r := server.SetReqCtx(httptest.NewRequest("GET", "/v0/proxy", nil), &server.ReqCtx{})
+	link := &ProxyLink{URL: "https://1.1.1.1/video.mkv", Constraints: &ProxyLinkConstraints{NotBefore: time.Now().Add(2 * time.Hour)}}
+	s.Error(validateProxyLink(r, link, time.Hour, ""))
+
+	link.Constraints = &ProxyLinkConstraints{}
+	s.NoError(validateProxyLink(r, link, time.Hour, ""))
+	s.Nil(link.Constraints)
+}
+
+func TestProxyLinkConstraints(t *testing.T) {
+	suite.Run(t, new(ProxyLinkConstraintsTestSuite))
+}
@@ -0,0 +1,337 @@
+package shared
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/Dydhzo/stremthru-proxy/core"
+	"github.com/Dydhzo/stremthru-proxy/internal/config"
+	"github.com/Dydhzo/stremthru-proxy/internal/logger"
+	"github.com/Dydhzo/stremthru-proxy/internal/store"
+)
+
+const (
+	proxyLinkRecordBucket       = "proxy_link_record"
+	proxyLinkRecordByUserBucket = "proxy_link_record_by_user"
+	// revoked link id to its expiry, kept until the link expires on its own
+	revokedProxyLinkBucket = "proxy_link_revoked"
+)
+
+var proxyLinkLog = logger.Scoped("proxy_link")
+
+// proxyLinkRecord is what is kept of a created link, without its upstream url
+type proxyLinkRecord struct {
+	ID           string `json:"id"`
+	User         string `json:"u"`
+	Host         string `json:"host"`
+	Filename     string `json:"filename,omitempty"`
+	Short        bool   `json:"short,omitempty"`
+	CreatedAt    int64  `json:"created_at"`
+	ExpiresAt    int64  `json:"exp,omitempty"`
+	LastAccessAt int64  `json:"last_access_at,omitempty"`
+	BytesServed  int64  `json:"bytes,omitempty"`
+}
+
+func (rec *proxyLinkRecord) isExpired(now time.Time) bool {
+	return rec.ExpiresAt != 0 && now.Unix() >= rec.ExpiresAt
+}
+
+// ProxyLinkRecord describes a created proxy link and its usage
+type ProxyLinkRecord struct {
+	ID           string
+	User         string
+	Host         string
+	Filename     string
+	Short        bool
+	CreatedAt    time.Time
+	ExpiresAt    time.Time
+	LastAccessAt time.Time
+	BytesServed  int64
+}
+
+func (rec *proxyLinkRecord) toProxyLinkRecord() *ProxyLinkRecord {
+	plr := &ProxyLinkRecord{
+		ID:          rec.ID,
+		User:        rec.User,
+		Host:        rec.Host,
+		Filename:    rec.Filename,
+		Short:       rec.Short,
+		CreatedAt:   time.Unix(rec.CreatedAt, 0),
+		BytesServed: rec.BytesServed,
+	}
+	if rec.ExpiresAt != 0 {
+		plr.ExpiresAt = time.Unix(rec.ExpiresAt, 0)
+	}
+	if rec.LastAccessAt != 0 {
+		plr.LastAccessAt = time.Unix(rec.LastAccessAt, 0)
+	}
+	return plr
+}
+
+func deleteProxyLinkRecord(tx *store.Tx, user, id string) error {
+	if err := tx.Delete(proxyLinkRecordBucket, id); err != nil {
+		return err
+	}
+	if err := tx.Delete(proxyLinkUsageBucket, id); err != nil {
+		return err
+	}
+	return tx.Delete(proxyLinkRecordByUserBucket, storeUserKey(user, id))
+}
+
+func sweepProxyLinkRecords(s *store.Store, now time.Time) (int, error) {
+	expired := []*proxyLinkRecord{}
+	revoked := []string{}
+	err := s.View(func(tx *store.Tx) error {
+		err := tx.ForEach(proxyLinkRecordBucket, "", func(key string, value []byte) error {
+			rec := &proxyLinkRecord{}
+			if err := json.Unmarshal(value, rec); err == nil && rec.isExpired(now) {
+				expired = append(expired, rec)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return tx.ForEach(revokedProxyLinkBucket, "", func(key string, value []byte) error {
+			if exp, err := strconv.ParseInt(string(value), 10, 64); err == nil && exp != 0 && now.Unix() >= exp {
+				revoked = append(revoked, key)
+			}
+			return nil
+		})
+	})
+	if err != nil || len(expired)+len(revoked) == 0 {
+		return 0, err
+	}
+	err = s.Update(func(tx *store.Tx) error {
+		for _, rec := range expired {
+			if err := deleteProxyLinkRecord(tx, rec.User, rec.ID); err != nil {
+				return err
+			}
+		}
+		for _, id := range revoked {
+			if err := tx.Delete(revokedProxyLinkBucket, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return len(expired) + len(revoked), err
+}
+
+// RecordProxyLink keeps track of a link created through the API, so its
+// owner can list and revoke it. Only the upstream host is kept.
+func RecordProxyLink(link *ProxyLink, filename string, short bool) {
+	if !config.ProxyLinkRecords {
+		return
+	}
+	s, err := getStore()
+	if err != nil {
+		proxyLinkLog.Error("failed to record link", "id", link.ID, "error", err)
+		return
+	}
+	rec := &proxyLinkRecord{
+		ID:        link.ID,
+		User:      link.User,
+		Filename:  filename,
+		Short:     short,
+		CreatedAt: time.Now().Unix(),
+	}
+	if u, err := url.Parse(link.URL); err == nil {
+		rec.Host = u.Hostname()
+	}
+	if !link.ExpiresAt.IsZero() {
+		rec.ExpiresAt = link.ExpiresAt.Unix()
+	}
+	blob, err := json.Marshal(rec)
+	if err == nil {
+		err = s.Update(func(tx *store.Tx) error {
+			if err := tx.Put(proxyLinkRecordBucket, rec.ID, blob); err != nil {
+				return err
+			}
+			return tx.Put(proxyLinkRecordByUserBucket, storeUserKey(rec.User, rec.ID), nil)
+		})
+	}
+	if err != nil {
+		proxyLinkLog.Error("failed to record link", "id", rec.ID, "error", err)
+	}
+}
+
+// RecordProxyLinkAccess adds a finished access to the usage of link id,
+// links created before records were kept are ignored.
+func RecordProxyLinkAccess(id string, bytesServed int64) {
+	if id == "" || !config.ProxyLinkRecords {
+		return
+	}
+	s, err := getStore()
+	if err != nil {
+		return
+	}
+	now := time.Now().Unix()
+	err = s.Batch(func(tx *store.Tx) error {
+		value := tx.Get(proxyLinkRecordBucket, id)
+		if value == nil {
+			return nil
+		}
+		rec := &proxyLinkRecord{}
+		if err := json.Unmarshal(value, rec); err != nil {
+			return err
+		}
+		rec.LastAccessAt = now
+		rec.BytesServed += bytesServed
+		blob, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		return tx.Put(proxyLinkRecordBucket, id, blob)
+	})
+	if err != nil {
+		proxyLinkLog.Error("failed to record link access", "id", id, "error", err)
+	}
+}
+
+func errProxyLinkRecordsDisabled() error {
+	err := core.NewAPIError("proxy link records disabled")
+	err.StatusCode = http.StatusNotFound
+	return err
+}
+
+// ListProxyLinkRecords returns the links created by user, or by every user
+// when empty, newest first.
+func ListProxyLinkRecords(user string) ([]*ProxyLinkRecord, error) {
+	if !config.ProxyLinkRecords {
+		return nil, errProxyLinkRecordsDisabled()
+	}
+	s, err := getStore()
+	if err != nil {
+		return nil, err
+	}
+	records := []*ProxyLinkRecord{}
+	err = s.View(func(tx *store.Tx) error {
+		if user == "" {
+			return tx.ForEach(proxyLinkRecordBucket, "", func(key string, value []byte) error {
+				rec := &proxyLinkRecord{}
+				if err := json.Unmarshal(value, rec); err != nil {
+					return err
+				}
+				records = append(records, rec.toProxyLinkRecord())
+				return nil
+			})
+		}
+		return tx.ForEach(proxyLinkRecordByUserBucket, storeUserKey(user, ""), func(key string, _ []byte) error {
+			value := tx.Get(proxyLinkRecordBucket, key[len(user)+1:])
+			if value == nil {
+				return nil
+			}
+			rec := &proxyLinkRecord{}
+			if err := json.Unmarshal(value, rec); err != nil {
+				return err
+			}
+			records = append(records, rec.toProxyLinkRecord())
+			return nil
+		})
+	})
+	slices.SortStableFunc(records, func(a, b *ProxyLinkRecord) int {
+		return b.CreatedAt.Compare(a.CreatedAt)
+	})
+	return records, err
+}
+
+func getProxyLinkRecord(tx *store.Tx, user, id string) (*proxyLinkRecord, error) {
+	value := tx.Get(proxyLinkRecordBucket, id)
+	if value == nil {
+		return nil, errProxyLinkNotFound()
+	}
+	rec := &proxyLinkRecord{}
+	if err := json.Unmarshal(value, rec); err != nil {
+		return nil, err
+	}
+	if user != "" && rec.User != user {
+		return nil, errProxyLinkNotFound()
+	}
+	return rec, nil
+}
+
+// GetProxyLinkRecord returns link id created by user, or by any user when empty
+func GetProxyLinkRecord(user, id string) (*ProxyLinkRecord, error) {
+	if !config.ProxyLinkRecords {
+		return nil, errProxyLinkRecordsDisabled()
+	}
+	s, err := getStore()
+	if err != nil {
+		return nil, err
+	}
+	var plr *ProxyLinkRecord
+	err = s.View(func(tx *store.Tx) error {
+		rec, err := getProxyLinkRecord(tx, user, id)
+		if err != nil {
+			return err
+		}
+		plr = rec.toProxyLinkRecord()
+		return nil
+	})
+	return plr, err
+}
+
+// RevokeProxyLink stops link id created by user, or by any user when empty,
+// from being served. Short links are deleted, tokens are denied until they
+// expire.
+func RevokeProxyLink(user, id string) error {
+	if !config.ProxyLinkRecords {
+		return errProxyLinkRecordsDisabled()
+	}
+	s, err := getStore()
+	if err != nil {
+		return err
+	}
+	return s.Update(func(tx *store.Tx) error {
+		rec, err := getProxyLinkRecord(tx, user, id)
+		if err != nil {
+			return err
+		}
+		if rec.Short {
+			if err := tx.Delete(shortLinkBucket, id); err != nil {
+				return err
+			}
+			if err := tx.Delete(shortLinkByUserBucket, storeUserKey(rec.User, id)); err != nil {
+				return err
+			}
+		} else if err := tx.Put(revokedProxyLinkBucket, id, []byte(strconv.FormatInt(rec.ExpiresAt, 10))); err != nil {
+			return err
+		}
+		return deleteProxyLinkRecord(tx, rec.User, id)
+	})
+}
+
+// Links can only be revoked when records are kept, the store is not opened
+// otherwise. Links are not served while the store is unavailable, so a
+// revoked link is never served.
+func checkProxyLinkRevoked(link *ProxyLink) error {
+	if link.ID == "" || !config.ProxyLinkRecords {
+		return nil
+	}
+	isRevoked := false
+	s, err := getStore()
+	if err == nil {
+		err = s.View(func(tx *store.Tx) error {
+			isRevoked = tx.Get(revokedProxyLinkBucket, link.ID) != nil
+			return nil
+		})
+	}
+	if err != nil {
+		proxyLinkLog.Error("failed to check link revocation", "id", link.ID, "error", err)
+		rerr := core.NewAPIError("proxy link revocation unavailable")
+		rerr.StatusCode = http.StatusServiceUnavailable
+		rerr.Cause = err
+		return rerr
+	}
+	if isRevoked {
+		err := core.NewAPIError("proxy link revoked")
+		err.StatusCode = http.StatusGone
+		return err
+	}
+	return nil
+}
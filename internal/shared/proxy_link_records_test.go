@@ -0,0 +1,142 @@
+package shared
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Dydhzo/stremthru-proxy/core"
+	"github.com/Dydhzo/stremthru-proxy/internal/config"
+	"github.com/Dydhzo/stremthru-proxy/internal/server"
+	"github.com/stretchr/testify/suite"
+)
+
+type ProxyLinkRecordTestSuite struct {
+	suite.Suite
+}
+
+func (s *ProxyLinkRecordTestSuite) SetupSuite() {
+	config.ProxyAuth["records"] = "pass"
+}
+
+func (s *ProxyLinkRecordTestSuite) TearDownSuite() {
+	delete(config.ProxyAuth, "records")
+}
+
+func (s *ProxyLinkRecordTestSuite) create(short bool, expiresIn time.Duration) (*ProxyLink, string) {
+	r := httptest.NewRequest("GET", "/v0/proxy", nil)
+	r = server.SetReqCtx(r, &server.ReqCtx{})
+	link := &ProxyLink{User: "records", URL: "https://1.1.1.1/video.mkv"}
+	createProxyLink := CreateProxyLink
+	if short {
+		createProxyLink = CreateShortProxyLink
+	}
+	proxyURL, err := createProxyLink(r, link, expiresIn, "pass", "video.mkv")
+	s.Require().NoError(err)
+	RecordProxyLink(link, "video.mkv", short)
+	return link, proxyURL
+}
+
+func (s *ProxyLinkRecordTestSuite) statusCode(err error) int {
+	if e, ok := err.(*core.APIError); ok {
+		return e.StatusCode
+	}
+	return 0
+}
+
+func (s *ProxyLinkRecordTestSuite) TestRecord() {
+	link, _ := s.create(false, time.Hour)
+
+	RecordProxyLinkAccess(link.ID, 100)
+	RecordProxyLinkAccess(link.ID, 50)
+
+	plr, err := GetProxyLinkRecord("records", link.ID)
+	s.Require().NoError(err)
+	s.Equal("1.1.1.1", plr.Host)
+	s.Equal("video.mkv", plr.Filename)
+	s.Equal(link.ExpiresAt.Unix(), plr.ExpiresAt.Unix())
+	s.Equal(int64(150), plr.BytesServed)
+	s.False(plr.LastAccessAt.IsZero())
+
+	_, err = GetProxyLinkRecord("other", link.ID)
+	s.Equal(http.StatusNotFound, s.statusCode(err))
+	_, err = GetProxyLinkRecord("", link.ID)
+	s.NoError(err)
+
+	records, err := ListProxyLinkRecords("records")
+	s.Require().NoError(err)
+	s.Contains(func() []string {
+		ids := []string{}
+		for _, plr := range records {
+			ids = append(ids, plr.ID)
+		}
+		return ids
+	}(), link.ID)
+
+	records, err = ListProxyLinkRecords("other")
+	s.Require().NoError(err)
+	s.Empty(records)
+}
+
+func (s *ProxyLinkRecordTestSuite) TestRevokeToken() {
+	link, proxyURL := s.create(false, time.Hour)
+	token := strings.Split(strings.SplitAfter(proxyURL, "/v0/proxy/")[1], "/")[0]
+
+	_, err := UnwrapProxyLinkToken(token)
+	s.Require().NoError(err)
+
+	s.Equal(http.StatusNotFound, s.statusCode(RevokeProxyLink("other", link.ID)))
+	s.Require().NoError(RevokeProxyLink("records", link.ID))
+
+	_, err = UnwrapProxyLinkToken(token)
+	s.Equal(http.StatusGone, s.statusCode(err))
+	_, err = GetProxyLinkRecord("records", link.ID)
+	s.Equal(http.StatusNotFound, s.statusCode(err))
+
+	st, err := getStore()
+	s.Require().NoError(err)
+	count, err := sweepProxyLinkRecords(st, time.Now().Add(2*time.Hour))
+	s.Require().NoError(err)
+	s.GreaterOrEqual(count, 1)
+	s.NoError(checkProxyLinkRevoked(link))
+}
+
+func (s *ProxyLinkRecordTestSuite) TestRevokeShortLink() {
+	link, _ := s.create(true, 0)
+
+	s.Require().NoError(RevokeProxyLink("", link.ID))
+
+	_, err := AccessShortProxyLink(link.ID)
+	s.Equal(http.StatusNotFound, s.statusCode(err))
+}
+
+func (s *ProxyLinkRecordTestSuite) TestDeleteShortLink() {
+	link, _ := s.create(true, 0)
+
+	s.Require().NoError(DeleteShortProxyLink("records", link.ID))
+
+	_, err := GetProxyLinkRecord("records", link.ID)
+	s.Equal(http.StatusNotFound, s.statusCode(err))
+}
+
+func (s *ProxyLinkRecordTestSuite) TestDisabled() {
+	link, _ := s.create(false, time.Hour)
+	s.Require().NoError(RevokeProxyLink("records", link.ID))
+
+	config.ProxyLinkRecords = false
+	defer func() { config.ProxyLinkRecords = true }()
+
+	s.NoError(checkProxyLinkRevoked(link), "the store is not read without records")
+	s.Equal(http.StatusNotFound, s.statusCode(RevokeProxyLink("records", link.ID)))
+
+	unrecorded, _ := s.create(false, time.Hour)
+	config.ProxyLinkRecords = true
+	_, err := GetProxyLinkRecord("records", unrecorded.ID)
+	s.Equal(http.StatusNotFound, s.statusCode(err))
+}
+
+func TestProxyLinkRecord(t *testing.T) {
+	suite.Run(t, new(ProxyLinkRecordTestSuite))
+}
@@ -0,0 +1,402 @@
+package shared
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/Dydhzo/stremthru-proxy/core"
+	"github.com/Dydhzo/stremthru-proxy/internal/config"
+	"github.com/rs/xid"
+)
+
+// Compact tokens are "c." followed by unpadded url-safe base64 of:
+//
+//	version | flags | len(user) | user | body
+//
+// The body is a sequence of tag | len | value fields, deflated when that
+// makes it smaller. Encrypted bodies are sealed with the header as
+// associated data, others are followed by a truncated HMAC of the whole.
+//
+// The body carries a fingerprint of the user password, checked against the
+// configured users on decode. Fully sealed tokens only keep version | flags
+// in clear, the user moves into the body, sealed with a server key.
+const compactTokenPrefix = "c."
+
+const compactTokenVersion byte = 1
+
+const (
+	compactFlagEncrypted byte = 1 << iota
+	compactFlagDeflated
+	compactFlagSealed
+)
+
+const (
+	compactTagID byte = iota + 1
+	compactTagURL
+	compactTagHeaders
+	compactTagExpiresAt
+	compactTagTunnel
+	compactTagResponseHeaders
+	compactTagMethods
+	compactTagUser
+	compactTagPasswordHash
+	compactTagConstraints
+)
+
+// Request header names stored as a single byte, indexes must never change.
+var compactHeaderNames = []string{
+	"Referer",
+	"User-Agent",
+	"Origin",
+	"Cookie",
+	"Authorization",
+	"Accept",
+	"Accept-Language",
+	"Range",
+}
+
+var errMalformedToken = errors.New("malformed token")
+
+func appendCompactField(buf []byte, tag byte, value []byte) []byte {
+	buf = append(buf, tag)
+	buf = binary.AppendUvarint(buf, uint64(len(value)))
+	return append(buf, value...)
+}
+
+func appendCompactString(buf []byte, value string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(value)))
+	return append(buf, value...)
+}
+
+// Header names from compactHeaderNames are written as 0 followed by their index.
+func encodeCompactHeaders(headers map[string]string) []byte {
+	keys := make([]string, 0, len(headers))
+	for k := range headers {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	buf := []byte{}
+	for _, k := range keys {
+		if idx := slices.Index(compactHeaderNames, http.CanonicalHeaderKey(k)); idx != -1 {
+			buf = append(buf, 0, byte(idx))
+		} else {
+			buf = appendCompactString(buf, k)
+		}
+		buf = appendCompactString(buf, headers[k])
+	}
+	return buf
+}
+
+func encodeCompactMethods(methods []string) byte {
+	var mask byte
+	for _, method := range methods {
+		if idx := slices.Index(proxyLinkMethods, method); idx != -1 {
+			mask |= 1 << idx
+		}
+	}
+	return mask
+}
+
+func encodeCompactBody(link *ProxyLink) ([]byte, error) {
+	body := []byte{}
+	if id, err := xid.FromString(link.ID); err == nil {
+		body = appendCompactField(body, compactTagID, id.Bytes())
+	}
+	body = appendCompactField(body, compactTagURL, []byte(link.URL))
+	if len(link.Headers) > 0 {
+		body = appendCompactField(body, compactTagHeaders, encodeCompactHeaders(link.Headers))
+	}
+	if !link.ExpiresAt.IsZero() {
+		body = appendCompactField(body, compactTagExpiresAt, binary.AppendUvarint(nil, uint64(link.ExpiresAt.Unix())))
+	}
+	if link.TunnelType != config.TUNNEL_TYPE_NONE {
+		body = appendCompactField(body, compactTagTunnel, []byte(link.TunnelType))
+	}
+	if link.ResponseHeaders != nil {
+		blob, err := json.Marshal(link.ResponseHeaders)
+		if err != nil {
+			return nil, err
+		}
+		body = appendCompactField(body, compactTagResponseHeaders, blob)
+	}
+	if len(link.Methods) > 0 {
+		body = appendCompactField(body, compactTagMethods, []byte{encodeCompactMethods(link.Methods)})
+	}
+	if link.Constraints != nil {
+		blob, err := json.Marshal(link.Constraints)
+		if err != nil {
+			return nil, err
+		}
+		body = appendCompactField(body, compactTagConstraints, blob)
+	}
+	return body, nil
+}
+
+type compactReader struct {
+	buf []byte
+}
+
+func (cr *compactReader) readUvarint() (uint64, error) {
+	value, n := binary.Uvarint(cr.buf)
+	if n <= 0 {
+		return 0, errMalformedToken
+	}
+	cr.buf = cr.buf[n:]
+	return value, nil
+}
+
+func (cr *compactReader) readBytes() ([]byte, error) {
+	size, err := cr.readUvarint()
+	if err != nil {
+		return nil, err
+	}
+	if size > uint64(len(cr.buf)) {
+		return nil, errMalformedToken
+	}
+	value := cr.buf[:size]
+	cr.buf = cr.buf[size:]
+	return value, nil
+}
+
+func (cr *compactReader) readByte() (byte, error) {
+	if len(cr.buf) == 0 {
+		return 0, errMalformedToken
+	}
+	b := cr.buf[0]
+	cr.buf = cr.buf[1:]
+	return b, nil
+}
+
+func decodeCompactHeaders(value []byte) (map[string]string, error) {
+	headers := map[string]string{}
+	cr := &compactReader{buf: value}
+	for len(cr.buf) > 0 {
+		name, err := cr.readBytes()
+		if err != nil {
+			return nil, err
+		}
+		key := string(name)
+		if len(name) == 0 {
+			idx, err := cr.readByte()
+			if err != nil || int(idx) >= len(compactHeaderNames) {
+				return nil, errMalformedToken
+			}
+			key = compactHeaderNames[idx]
+		}
+		v, err := cr.readBytes()
+		if err != nil {
+			return nil, err
+		}
+		headers[key] = string(v)
+	}
+	return headers, nil
+}
+
+// Unknown tags are skipped, so fields can be added without a new version.
+func decodeCompactBody(body []byte, link *ProxyLink, passwordHash *[]byte) error {
+	cr := &compactReader{buf: body}
+	for len(cr.buf) > 0 {
+		tag, err := cr.readByte()
+		if err != nil {
+			return err
+		}
+		value, err := cr.readBytes()
+		if err != nil {
+			return err
+		}
+		switch tag {
+		case compactTagID:
+			id, err := xid.FromBytes(value)
+			if err != nil {
+				return errMalformedToken
+			}
+			link.ID = id.String()
+		case compactTagURL:
+			link.URL = string(value)
+		case compactTagHeaders:
+			if link.Headers, err = decodeCompactHeaders(value); err != nil {
+				return err
+			}
+		case compactTagExpiresAt:
+			exp, n := binary.Uvarint(value)
+			if n <= 0 {
+				return errMalformedToken
+			}
+			link.ExpiresAt = time.Unix(int64(exp), 0)
+		case compactTagTunnel:
+			link.TunnelType = config.TunnelType(value)
+		case compactTagResponseHeaders:
+			link.ResponseHeaders = &config.ResponseHeaderRules{}
+			if err := json.Unmarshal(value, link.ResponseHeaders); err != nil {
+				return errMalformedToken
+			}
+		case compactTagConstraints:
+			link.Constraints = &ProxyLinkConstraints{}
+			if err := json.Unmarshal(value, link.Constraints); err != nil {
+				return errMalformedToken
+			}
+		case compactTagUser:
+			link.User = string(value)
+		case compactTagPasswordHash:
+			*passwordHash = value
+		case compactTagMethods:
+			if len(value) != 1 {
+				return errMalformedToken
+			}
+			for idx, method := range proxyLinkMethods {
+				if value[0]&(1<<idx) != 0 {
+					link.Methods = append(link.Methods, method)
+				}
+			}
+		}
+	}
+	if link.URL == "" {
+		return errMalformedToken
+	}
+	return nil
+}
+
+func deflate(data []byte) []byte {
+	var buf bytes.Buffer
+	fw, _ := flate.NewWriter(&buf, flate.BestCompression)
+	fw.Write(data)
+	fw.Close()
+	return buf.Bytes()
+}
+
+func inflate(data []byte) ([]byte, error) {
+	// bodies are bounded by the url length, a larger output is not a token of ours
+	fr := flate.NewReader(bytes.NewReader(data))
+	defer fr.Close()
+	out, err := io.ReadAll(io.LimitReader(fr, 64<<10))
+	if err != nil {
+		return nil, errMalformedToken
+	}
+	return out, nil
+}
+
+func encodeCompactProxyLinkToken(link *ProxyLink, password string) (string, error) {
+	body, err := encodeCompactBody(link)
+	if err != nil {
+		return "", err
+	}
+
+	// a password change revokes every token of the user, like base64 tokens
+	body = appendCompactField(body, compactTagPasswordHash, core.TokenPasswordHash(password))
+
+	isSealed := config.ProxyTokenEncryption == config.TOKEN_ENCRYPTION_FULL
+	if isSealed {
+		link.Encrypted = true
+		body = appendCompactField(body, compactTagUser, []byte(link.User))
+	}
+
+	flags := byte(0)
+	if deflated := deflate(body); len(deflated) < len(body) {
+		body = deflated
+		flags |= compactFlagDeflated
+	}
+
+	var token []byte
+	switch {
+	case isSealed:
+		header := []byte{compactTokenVersion, flags | compactFlagSealed}
+		sealed, err := core.SealTokenEnvelope(body, header)
+		if err != nil {
+			return "", err
+		}
+		token = append(header, sealed...)
+	case link.Encrypted:
+		header := appendCompactString([]byte{compactTokenVersion, flags | compactFlagEncrypted}, link.User)
+		sealed, err := core.SealToken(password, body, header)
+		if err != nil {
+			return "", err
+		}
+		token = append(header, sealed...)
+	default:
+		header := appendCompactString([]byte{compactTokenVersion, flags}, link.User)
+		token = core.SignToken(append(header, body...))
+	}
+
+	return compactTokenPrefix + base64.RawURLEncoding.EncodeToString(token), nil
+}
+
+func decodeCompactProxyLinkToken(encodedToken string) (*ProxyLink, error) {
+	blob, err := base64.RawURLEncoding.DecodeString(encodedToken[len(compactTokenPrefix):])
+	if err != nil {
+		return nil, errMalformedToken
+	}
+
+	cr := &compactReader{buf: blob}
+	version, err := cr.readByte()
+	if err != nil {
+		return nil, err
+	}
+	if version != compactTokenVersion {
+		return nil, errors.New("unsupported token version")
+	}
+	flags, err := cr.readByte()
+	if err != nil {
+		return nil, err
+	}
+
+	link := &ProxyLink{}
+
+	var body []byte
+	var passwordHash []byte
+	if flags&compactFlagSealed != 0 {
+		if body, err = core.OpenTokenEnvelope(cr.buf, blob[:2]); err != nil {
+			return nil, err
+		}
+		link.Encrypted = true
+	} else {
+		user, err := cr.readBytes()
+		if err != nil {
+			return nil, err
+		}
+		header := blob[:len(blob)-len(cr.buf)]
+		link.User = string(user)
+
+		if flags&compactFlagEncrypted != 0 {
+			password, ok := config.ProxyAuth[link.User]
+			if !ok {
+				return nil, core.ErrInvalidToken
+			}
+			if body, err = core.OpenToken(password, cr.buf, header); err != nil {
+				return nil, err
+			}
+			link.Encrypted = true
+		} else {
+			data, err := core.VerifyToken(blob)
+			if err != nil {
+				return nil, err
+			}
+			body = data[len(header):]
+		}
+	}
+
+	if flags&compactFlagDeflated != 0 {
+		if body, err = inflate(body); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := decodeCompactBody(body, link, &passwordHash); err != nil {
+		return nil, err
+	}
+
+	password, ok := config.ProxyAuth[link.User]
+	if !ok || !hmac.Equal(passwordHash, core.TokenPasswordHash(password)) {
+		return nil, core.ErrInvalidToken
+	}
+	return link, nil
+}
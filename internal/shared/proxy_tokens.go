@@ -1,55 +1,261 @@
 package shared
 
 import (
+	"crypto/hmac"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/rs/xid"
 	"github.com/Dydhzo/stremthru-proxy/core"
 	"github.com/Dydhzo/stremthru-proxy/internal/cache"
 	"github.com/Dydhzo/stremthru-proxy/internal/config"
 )
 
 type proxyLinkTokenData struct {
-	EncLink    string            `json:"enc_link"`
-	EncFormat  string            `json:"enc_format"`
-	TunnelType config.TunnelType `json:"tunt,omitempty"`
+	EncLink    string                      `json:"enc_link"`
+	EncFormat  string                      `json:"enc_format"`
+	TunnelType config.TunnelType           `json:"tunt,omitempty"`
+	RespH      *config.ResponseHeaderRules `json:"resh,omitempty"`
+	Methods    []string                    `json:"meth,omitempty"`
+	Cons       *ProxyLinkConstraints       `json:"cons,omitempty"`
 }
 
 type proxyLinkData struct {
-	User    string            `json:"u"`
-	Value   string            `json:"v"`
-	Headers map[string]string `json:"reqh,omitempty"`
-	TunT    config.TunnelType `json:"tunt,omitempty"`
+	ID      string                      `json:"id,omitempty"`
+	User    string                      `json:"u"`
+	Value   string                      `json:"v"`
+	Headers map[string]string           `json:"reqh,omitempty"`
+	TunT    config.TunnelType           `json:"tunt,omitempty"`
+	RespH   *config.ResponseHeaderRules `json:"resh,omitempty"`
+	Methods []string                    `json:"meth,omitempty"`
+	Cons    *ProxyLinkConstraints       `json:"cons,omitempty"`
+	// Fingerprint of the user password, legacy tokens have "user:password" in User instead
+	PwH []byte `json:"pwh,omitempty"`
 }
 
-var proxyLinkTokenCache = func() cache.Cache[proxyLinkData] {
-	return cache.NewCache[proxyLinkData](&cache.CacheConfig{
+// Signed base64 tokens are "base64.<json>.<signature>", password-bearing
+// legacy ones have no signature.
+const base64TokenPrefix = "base64."
+
+// ProxyLink describes the upstream request carried by a proxy link token
+type ProxyLink struct {
+	ID              string
+	User            string
+	URL             string
+	Headers         map[string]string
+	TunnelType      config.TunnelType
+	ExpiresAt       time.Time
+	Encrypted       bool
+	ResponseHeaders *config.ResponseHeaderRules
+	// Methods allowed on top of GET and HEAD
+	Methods     []string
+	Constraints *ProxyLinkConstraints
+	// stored server side, keyed by its ID
+	short bool
+}
+
+// Methods a link can opt into, GET and HEAD are always allowed.
+var proxyLinkMethods = []string{
+	http.MethodPost,
+	http.MethodPut,
+	http.MethodPatch,
+	http.MethodDelete,
+}
+
+// AllowsMethod reports whether the link can be accessed with method
+func (link *ProxyLink) AllowsMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || slices.Contains(link.Methods, method)
+}
+
+// ParseProxyLinkMethods normalizes methods, failing on ones a link can not opt into
+func ParseProxyLinkMethods(methods []string) ([]string, error) {
+	parsed := []string{}
+	for _, method := range methods {
+		method = strings.ToUpper(strings.TrimSpace(method))
+		switch {
+		case method == "", method == http.MethodGet, method == http.MethodHead, slices.Contains(parsed, method):
+		case slices.Contains(proxyLinkMethods, method):
+			parsed = append(parsed, method)
+		default:
+			return nil, errors.New("unsupported method: " + method)
+		}
+	}
+	if len(parsed) == 0 {
+		return nil, nil
+	}
+	return parsed, nil
+}
+
+var proxyLinkTokenCache = func() *cache.Cache[ProxyLink] {
+	return cache.NewCache[ProxyLink](&cache.CacheConfig{
 		Name:     "store:proxyLinkToken",
 		Lifetime: 30 * time.Minute,
+		MaxSize:  config.ProxyTokenCacheSize,
 	})
 }()
 
-func CreateProxyLink(r *http.Request, link string, headers map[string]string, tunnelType config.TunnelType, expiresIn time.Duration, user, password string, shouldEncrypt bool, filename string) (string, error) {
+const (
+	maxUpstreamURLLength = 4096
+	maxFilenameLength    = 255
+)
+
+// ValidateUpstreamURL checks that link is an absolute http(s) url the proxy
+// is allowed to request.
+func ValidateUpstreamURL(r *http.Request, link string) (*url.URL, error) {
+	if link == "" {
+		return nil, ErrorBadRequest(r, "missing url")
+	}
+	if len(link) > maxUpstreamURLLength {
+		return nil, ErrorBadRequest(r, "url too long, max "+strconv.Itoa(maxUpstreamURLLength)+" characters")
+	}
+	u, err := url.Parse(link)
+	if err != nil {
+		e := ErrorBadRequest(r, "invalid url")
+		e.Cause = err
+		return nil, e
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "http", "https":
+	case "":
+		return nil, ErrorBadRequest(r, "invalid url: missing scheme")
+	default:
+		return nil, ErrorBadRequest(r, "invalid url: unsupported scheme "+u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return nil, ErrorBadRequest(r, "invalid url: missing host")
+	}
+	if err := config.SSRF.CheckURL(r.Context(), u); err != nil {
+		e := ErrorForbidden(r)
+		e.Msg = err.Error()
+		e.Cause = err
+		return nil, e
+	}
+	return u, nil
+}
+
+func validateFilename(r *http.Request, filename string) error {
+	if len(filename) > maxFilenameLength {
+		return ErrorBadRequest(r, "filename too long, max "+strconv.Itoa(maxFilenameLength)+" characters")
+	}
+	if strings.ContainsAny(filename, "/\\") {
+		return ErrorBadRequest(r, "invalid filename")
+	}
+	return nil
+}
+
+// validateProxyLink checks link before it is handed out, normalizing its
+// methods and constraints
+func validateProxyLink(r *http.Request, link *ProxyLink, expiresIn time.Duration, filename string) error {
+	if _, err := ValidateUpstreamURL(r, link.URL); err != nil {
+		return err
+	}
+	if err := validateFilename(r, filename); err != nil {
+		return err
+	}
+	if link.ResponseHeaders != nil {
+		if err := link.ResponseHeaders.Validate(); err != nil {
+			return ErrorBadRequest(r, "invalid response headers: "+err.Error())
+		}
+	}
+	methods, err := ParseProxyLinkMethods(link.Methods)
+	if err != nil {
+		return ErrorBadRequest(r, err.Error())
+	}
+	link.Methods = methods
+	if link.Constraints.IsZero() {
+		link.Constraints = nil
+	} else {
+		expiresAt := time.Time{}
+		if expiresIn != 0 {
+			expiresAt = time.Now().Add(expiresIn)
+		}
+		if err := link.Constraints.validate(expiresAt); err != nil {
+			return ErrorBadRequest(r, err.Error())
+		}
+	}
+	return nil
+}
+
+// applyLinkExpiryPolicy returns the expiration of a link created by user
+// asking for expiresIn, zero asking for the default of the user policy.
+func applyLinkExpiryPolicy(r *http.Request, user string, expiresIn time.Duration) (time.Duration, error) {
+	policy := config.ProxyLinkExpiry.Get(user)
+	if expiresIn == 0 {
+		expiresIn = policy.Default
+		if expiresIn == 0 {
+			expiresIn = policy.Max
+		}
+	}
+	if policy.Max != 0 && expiresIn > policy.Max {
+		return 0, ErrorBadRequest(r, "expiration exceeds maximum of "+policy.Max.String())
+	}
+	if expiresIn == 0 && policy.RequireExpiry {
+		return 0, ErrorBadRequest(r, "expiration required")
+	}
+	return expiresIn, nil
+}
+
+// ProxyLinkInfoFilename is reserved, "/v0/proxy/{token}/info" serves the metadata of the link
+const ProxyLinkInfoFilename = "info"
+
+// CreateProxyLink signs link into a proxy url, filling in the link id and expiry
+func CreateProxyLink(r *http.Request, link *ProxyLink, expiresIn time.Duration, password string, filename string) (string, error) {
+	link.ID = xid.New().String()
+	return signProxyLink(r, link, expiresIn, password, filename)
+}
+
+// signProxyLink signs link into a proxy url under its id, filling in the expiry
+func signProxyLink(r *http.Request, link *ProxyLink, expiresIn time.Duration, password string, filename string) (string, error) {
+	expiresIn, err := applyLinkExpiryPolicy(r, link.User, expiresIn)
+	if err != nil {
+		return "", err
+	}
+	if err := validateProxyLink(r, link, expiresIn, filename); err != nil {
+		return "", err
+	}
+	if filename == ProxyLinkInfoFilename {
+		return "", ErrorBadRequest(r, "reserved filename: "+filename)
+	}
+
 	var encodedToken string
 
-	if !shouldEncrypt && expiresIn == 0 {
+	if config.ProxyTokenFormat == config.TOKEN_FORMAT_COMPACT {
+		if expiresIn != 0 {
+			link.ExpiresAt = time.Now().Add(expiresIn).Truncate(time.Second)
+		}
+		token, err := encodeCompactProxyLinkToken(link, password)
+		if err != nil {
+			return "", err
+		}
+		encodedToken = token
+	} else if !link.Encrypted && expiresIn == 0 {
 		blob, err := json.Marshal(proxyLinkData{
-			User:    user + ":" + password,
-			Value:   link,
-			Headers: headers,
-			TunT:    tunnelType,
+			ID:      link.ID,
+			User:    link.User,
+			Value:   link.URL,
+			Headers: link.Headers,
+			TunT:    link.TunnelType,
+			RespH:   link.ResponseHeaders,
+			Methods: link.Methods,
+			Cons:    link.Constraints,
+			PwH:     core.TokenPasswordHash(password),
 		})
 		if err != nil {
 			return "", err
 		}
-		encodedToken = "base64." + core.Base64EncodeByte(blob)
+		encodedToken = base64TokenPrefix + core.Base64EncodeByte(blob) + "." + base64.RawURLEncoding.EncodeToString(core.TokenSignature(blob))
 	} else {
-		linkBlob := link
-		if headers != nil {
-			for k, v := range headers {
+		linkBlob := link.URL
+		if link.Headers != nil {
+			for k, v := range link.Headers {
 				linkBlob += "\n" + k + ": " + v
 			}
 		}
@@ -57,7 +263,7 @@ func CreateProxyLink(r *http.Request, link string, headers map[string]string, tu
 		var encLink string
 		var encFormat string
 
-		if shouldEncrypt {
+		if link.Encrypted {
 			encryptedLink, err := core.Encrypt(password, linkBlob)
 			if err != nil {
 				return "", err
@@ -71,17 +277,22 @@ func CreateProxyLink(r *http.Request, link string, headers map[string]string, tu
 
 		claims := core.JWTClaims[proxyLinkTokenData]{
 			RegisteredClaims: jwt.RegisteredClaims{
+				ID:      link.ID,
 				Issuer:  "stremthru",
-				Subject: user,
+				Subject: link.User,
 			},
 			Data: &proxyLinkTokenData{
 				EncLink:    encLink,
 				EncFormat:  encFormat,
-				TunnelType: tunnelType,
+				TunnelType: link.TunnelType,
+				RespH:      link.ResponseHeaders,
+				Methods:    link.Methods,
+				Cons:       link.Constraints,
 			},
 		}
 		if expiresIn != 0 {
 			claims.RegisteredClaims.ExpiresAt = jwt.NewNumericDate(time.Now().Add(expiresIn))
+			link.ExpiresAt = claims.RegisteredClaims.ExpiresAt.Time
 		}
 
 		token, err := core.GenerateJWT(claims)
@@ -94,45 +305,136 @@ func CreateProxyLink(r *http.Request, link string, headers map[string]string, tu
 	baseURL := ExtractRequestBaseURL(r)
 	proxyURL := baseURL.String() + "/v0/proxy/" + encodedToken
 	if filename != "" {
-		proxyURL += "/" + filename
+		proxyURL += "/" + url.PathEscape(filename)
 	}
 
 	return proxyURL, nil
 }
 
-func UnwrapProxyLinkToken(encodedToken string) (user string, link string, headers map[string]string, tunnelType config.TunnelType, err error) {
+func checkProxyLinkExpiry(link *ProxyLink) error {
+	if !link.ExpiresAt.IsZero() && !time.Now().Before(link.ExpiresAt) {
+		err := core.NewAPIError("proxy link expired")
+		err.StatusCode = http.StatusGone
+		return err
+	}
+	return nil
+}
+
+// Tokens that failed to verify or decode, so repeated attempts skip the
+// signature check and decryption
+var invalidProxyLinkTokenCache = cache.NewCache[struct{}](&cache.CacheConfig{
+	Name:     "store:invalidProxyLinkToken",
+	Lifetime: 5 * time.Minute,
+	MaxSize:  10000,
+})
+
+// IsInvalidProxyLinkTokenError reports whether err means the token can never
+// be valid, as opposed to an expired or revoked link
+func IsInvalidProxyLinkTokenError(err error) bool {
+	if errors.Is(err, jwt.ErrTokenExpired) {
+		return false
+	}
+	var apiErr *core.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode == http.StatusUnauthorized
+	}
+	return true
+}
+
+func UnwrapProxyLinkToken(encodedToken string) (*ProxyLink, error) {
+	if _, ok := invalidProxyLinkTokenCache.Get(encodedToken); ok {
+		err := core.NewAPIError("unauthorized")
+		err.StatusCode = http.StatusUnauthorized
+		return nil, err
+	}
+	link, err := unwrapProxyLinkToken(encodedToken)
+	if err != nil && IsInvalidProxyLinkTokenError(err) {
+		invalidProxyLinkTokenCache.Set(encodedToken, struct{}{})
+	}
+	return link, err
+}
+
+func unwrapProxyLinkToken(encodedToken string) (*ProxyLink, error) {
 	if cached, ok := proxyLinkTokenCache.Get(encodedToken); ok {
-		return cached.User, cached.Value, cached.Headers, cached.TunT, nil
+		if err := checkProxyLinkExpiry(&cached); err != nil {
+			return nil, err
+		}
+		if err := checkProxyLinkRevoked(&cached); err != nil {
+			return nil, err
+		}
+		return &cached, nil
 	}
 
-	proxyLink := &proxyLinkData{}
+	proxyLink := &ProxyLink{}
 
-	if strings.HasPrefix(encodedToken, "base64.") {
-		blob, err := core.Base64DecodeByte(strings.TrimPrefix(encodedToken, "base64."))
+	if strings.HasPrefix(encodedToken, compactTokenPrefix) {
+		link, err := decodeCompactProxyLinkToken(encodedToken)
 		if err != nil {
-			return "", "", nil, "", err
+			rerr := core.NewAPIError("unauthorized")
+			rerr.StatusCode = http.StatusUnauthorized
+			rerr.Cause = err
+			return nil, rerr
+		}
+		if err := checkProxyLinkExpiry(link); err != nil {
+			return nil, err
+		}
+		proxyLink = link
+	} else if strings.HasPrefix(encodedToken, base64TokenPrefix) {
+		payload, signature, isSigned := strings.Cut(strings.TrimPrefix(encodedToken, base64TokenPrefix), ".")
+		blob, err := core.Base64DecodeByte(payload)
+		if err != nil {
+			return nil, err
 		}
-		if err := json.Unmarshal(blob, proxyLink); err != nil {
-			return "", "", nil, "", err
+		linkData := &proxyLinkData{}
+		if err := json.Unmarshal(blob, linkData); err != nil {
+			return nil, err
 		}
-		user, pass, _ := strings.Cut(proxyLink.User, ":")
-		if pass != config.ProxyAuth[user] {
+		user, isAuthorized := linkData.User, false
+		if isSigned {
+			sig, err := base64.RawURLEncoding.DecodeString(signature)
+			password, hasUser := config.ProxyAuth[user]
+			isAuthorized = err == nil && hasUser && hmac.Equal(sig, core.TokenSignature(blob)) && hmac.Equal(linkData.PwH, core.TokenPasswordHash(password))
+		} else {
+			if until := config.ProxyPasswordTokensUntil; !until.IsZero() && time.Now().After(until) {
+				err := core.NewAPIError("password bearing token no longer accepted, create a new link")
+				err.StatusCode = http.StatusUnauthorized
+				return nil, err
+			}
+			var pass string
+			user, pass, _ = strings.Cut(linkData.User, ":")
+			password, hasUser := config.ProxyAuth[user]
+			isAuthorized = hasUser && pass == password
+		}
+		if !isAuthorized {
 			err := core.NewAPIError("unauthorized")
 			err.StatusCode = http.StatusUnauthorized
-			return "", "", nil, "", err
+			return nil, err
 		}
+		proxyLink.ID = linkData.ID
 		proxyLink.User = user
+		proxyLink.URL = linkData.Value
+		proxyLink.Headers = linkData.Headers
+		proxyLink.TunnelType = linkData.TunT
+		proxyLink.ResponseHeaders = linkData.RespH
+		proxyLink.Methods = linkData.Methods
+		proxyLink.Constraints = linkData.Cons
 	} else {
 		// JWT token - parse with our existing function
 		claims, err := core.ParseJWT[proxyLinkTokenData](encodedToken)
+		if errors.Is(err, jwt.ErrTokenExpired) {
+			rerr := core.NewAPIError("proxy link expired")
+			rerr.StatusCode = http.StatusGone
+			rerr.Cause = err
+			return nil, rerr
+		}
 		if err != nil {
 			rerr := core.NewAPIError("unauthorized")
 			rerr.StatusCode = http.StatusUnauthorized
 			rerr.Cause = err
-			return "", "", nil, "", rerr
+			return nil, rerr
 		}
 
-		user = claims.Subject
+		user := claims.Subject
 
 		// For JWT tokens, we need the user's password for decryption
 		password := config.ProxyAuth[user]
@@ -141,22 +443,30 @@ func UnwrapProxyLinkToken(encodedToken string) (user string, link string, header
 		if claims.Data.EncFormat == "base64" {
 			blob, err := core.Base64Decode(claims.Data.EncLink)
 			if err != nil {
-				return "", "", nil, "", err
+				return nil, err
 			}
 			linkBlob = blob
 		} else {
 			blob, err := core.Decrypt(password, claims.Data.EncLink)
 			if err != nil {
-				return "", "", nil, "", err
+				return nil, err
 			}
 			linkBlob = blob
+			proxyLink.Encrypted = true
 		}
 
 		link, headersBlob, hasHeaders := strings.Cut(linkBlob, "\n")
 
+		proxyLink.ID = claims.ID
 		proxyLink.User = user
-		proxyLink.TunT = claims.Data.TunnelType
-		proxyLink.Value = link
+		proxyLink.TunnelType = claims.Data.TunnelType
+		proxyLink.ResponseHeaders = claims.Data.RespH
+		proxyLink.Methods = claims.Data.Methods
+		proxyLink.Constraints = claims.Data.Cons
+		proxyLink.URL = link
+		if claims.ExpiresAt != nil {
+			proxyLink.ExpiresAt = claims.ExpiresAt.Time
+		}
 
 		if hasHeaders {
 			proxyLink.Headers = map[string]string{}
@@ -168,7 +478,46 @@ func UnwrapProxyLinkToken(encodedToken string) (user string, link string, header
 		}
 	}
 
-	proxyLinkTokenCache.Set(encodedToken, *proxyLink)
+	// never served from the cache past the token expiry
+	proxyLinkTokenCache.SetWithExpiry(encodedToken, *proxyLink, proxyLink.ExpiresAt)
 
-	return proxyLink.User, proxyLink.Value, proxyLink.Headers, proxyLink.TunT, nil
-}
\ No newline at end of file
+	if err := checkProxyLinkRevoked(proxyLink); err != nil {
+		return nil, err
+	}
+
+	return proxyLink, nil
+}
+
+// Wraps an upstream redirect location in a proxy link carrying the same id,
+// tunnel, expiry and encryption as the link being served, so revoking the
+// link also revokes its redirects. The link headers are only carried over
+// when the location stays on the same host.
+func createRedirectProxyLink(r *http.Request, link *ProxyLink, location *url.URL) (string, error) {
+	var headers map[string]string
+	if initialUrl, err := url.Parse(link.URL); err == nil && isSameOrSubdomain(initialUrl.Hostname(), location.Hostname()) {
+		headers = link.Headers
+	}
+
+	expiresIn := time.Duration(0)
+	if !link.ExpiresAt.IsZero() {
+		expiresIn = time.Until(link.ExpiresAt)
+		if expiresIn <= 0 {
+			err := core.NewAPIError("proxy link expired")
+			err.StatusCode = http.StatusGone
+			return "", err
+		}
+	}
+	password := config.ProxyAuth[link.User]
+	redirectLink := &ProxyLink{
+		ID:              link.ID,
+		User:            link.User,
+		URL:             location.String(),
+		Headers:         headers,
+		TunnelType:      link.TunnelType,
+		Encrypted:       link.Encrypted,
+		ResponseHeaders: link.ResponseHeaders,
+		Methods:         link.Methods,
+		Constraints:     link.Constraints,
+	}
+	return signProxyLink(r, redirectLink, expiresIn, password, r.PathValue("filename"))
+}
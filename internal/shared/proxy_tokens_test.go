@@ -0,0 +1,250 @@
+package shared
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Dydhzo/stremthru-proxy/core"
+	"github.com/Dydhzo/stremthru-proxy/internal/config"
+	"github.com/Dydhzo/stremthru-proxy/internal/server"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/rs/xid"
+	"github.com/stretchr/testify/suite"
+)
+
+type CompactProxyLinkTokenTestSuite struct {
+	suite.Suite
+}
+
+func (s *CompactProxyLinkTokenTestSuite) SetupSuite() {
+	config.ProxyAuth["user"] = "pass"
+}
+
+func (s *CompactProxyLinkTokenTestSuite) TearDownSuite() {
+	delete(config.ProxyAuth, "user")
+}
+
+func (s *CompactProxyLinkTokenTestSuite) newLink(encrypted bool) *ProxyLink {
+	return &ProxyLink{
+		ID:         xid.New().String(),
+		User:       "user",
+		URL:        "https://cdn.example.com/path/to/Some.Movie.2024.2160p.mkv?sig=abcdef0123456789",
+		Headers:    map[string]string{"Referer": "https://example.com/", "X-Custom": "1"},
+		TunnelType: config.TUNNEL_TYPE_FORCED,
+		ExpiresAt:  time.Now().Add(time.Hour).Truncate(time.Second),
+		Encrypted:  encrypted,
+		ResponseHeaders: &config.ResponseHeaderRules{
+			ContentDisposition: "attachment",
+		},
+		Methods: []string{"POST", "DELETE"},
+	}
+}
+
+func (s *CompactProxyLinkTokenTestSuite) TestRoundTrip() {
+	for _, encrypted := range []bool{false, true} {
+		link := s.newLink(encrypted)
+
+		token, err := encodeCompactProxyLinkToken(link, "pass")
+		s.Require().NoError(err)
+		s.True(strings.HasPrefix(token, compactTokenPrefix))
+		s.NotContains(token, "=")
+
+		decoded, err := decodeCompactProxyLinkToken(token)
+		s.Require().NoError(err)
+		s.Equal(link.ExpiresAt.Unix(), decoded.ExpiresAt.Unix())
+		decoded.ExpiresAt = link.ExpiresAt
+		s.Equal(link, decoded)
+	}
+}
+
+func (s *CompactProxyLinkTokenTestSuite) TestTampered() {
+	for _, encrypted := range []bool{false, true} {
+		token, err := encodeCompactProxyLinkToken(s.newLink(encrypted), "pass")
+		s.Require().NoError(err)
+
+		last := token[len(token)-5]
+		replacement := "A"
+		if last == 'A' {
+			replacement = "B"
+		}
+		_, err = decodeCompactProxyLinkToken(token[:len(token)-5] + replacement + token[len(token)-4:])
+		s.Error(err)
+	}
+}
+
+func (s *CompactProxyLinkTokenTestSuite) TestWrongPassword() {
+	token, err := encodeCompactProxyLinkToken(s.newLink(true), "old-pass")
+	s.Require().NoError(err)
+
+	_, err = decodeCompactProxyLinkToken(token)
+	s.Error(err)
+}
+
+func (s *CompactProxyLinkTokenTestSuite) TestPasswordChanged() {
+	for _, encrypted := range []bool{false, true} {
+		token, err := encodeCompactProxyLinkToken(s.newLink(encrypted), "pass")
+		s.Require().NoError(err)
+
+		config.ProxyAuth["user"] = "changed"
+		_, err = decodeCompactProxyLinkToken(token)
+		s.Error(err, "password changed")
+
+		delete(config.ProxyAuth, "user")
+		_, err = decodeCompactProxyLinkToken(token)
+		s.Error(err, "user removed")
+
+		config.ProxyAuth["user"] = "pass"
+		_, err = decodeCompactProxyLinkToken(token)
+		s.NoError(err)
+	}
+}
+
+func (s *CompactProxyLinkTokenTestSuite) TestFullEncryption() {
+	defer func(encryption config.TokenEncryption) { config.ProxyTokenEncryption = encryption }(config.ProxyTokenEncryption)
+	config.ProxyTokenEncryption = config.TOKEN_ENCRYPTION_FULL
+
+	link := s.newLink(false)
+	token, err := encodeCompactProxyLinkToken(link, "pass")
+	s.Require().NoError(err)
+
+	blob, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(token, compactTokenPrefix))
+	s.Require().NoError(err)
+	s.NotContains(string(blob), "user")
+
+	decoded, err := decodeCompactProxyLinkToken(token)
+	s.Require().NoError(err)
+	s.True(decoded.Encrypted)
+	s.Equal("user", decoded.User)
+	s.Equal(link.URL, decoded.URL)
+
+	config.ProxyAuth["user"] = "changed"
+	defer func() { config.ProxyAuth["user"] = "pass" }()
+	_, err = decodeCompactProxyLinkToken(token)
+	s.Error(err)
+}
+
+func TestCompactProxyLinkToken(t *testing.T) {
+	suite.Run(t, new(CompactProxyLinkTokenTestSuite))
+}
+
+type Base64ProxyLinkTokenTestSuite struct {
+	suite.Suite
+}
+
+func (s *Base64ProxyLinkTokenTestSuite) SetupSuite() {
+	config.ProxyAuth["user"] = "pass"
+}
+
+func (s *Base64ProxyLinkTokenTestSuite) TearDownSuite() {
+	delete(config.ProxyAuth, "user")
+}
+
+func (s *Base64ProxyLinkTokenTestSuite) TestSigned() {
+	defer func(format config.TokenFormat) { config.ProxyTokenFormat = format }(config.ProxyTokenFormat)
+	config.ProxyTokenFormat = config.TOKEN_FORMAT_LEGACY
+
+	r := httptest.NewRequest("GET", "/v0/proxy", nil)
+	r = server.SetReqCtx(r, &server.ReqCtx{})
+	proxyURL, err := CreateProxyLink(r, &ProxyLink{User: "user", URL: "https://1.1.1.1/video.mkv"}, 0, "pass", "")
+	s.Require().NoError(err)
+
+	token := proxyURL[strings.LastIndex(proxyURL, "/")+1:]
+	s.True(strings.HasPrefix(token, base64TokenPrefix))
+	payload, _, _ := strings.Cut(strings.TrimPrefix(token, base64TokenPrefix), ".")
+	blob, err := base64.StdEncoding.DecodeString(payload)
+	s.Require().NoError(err)
+	s.NotContains(string(blob), "pass")
+
+	link, err := UnwrapProxyLinkToken(token)
+	s.Require().NoError(err)
+	s.Equal("user", link.User)
+	s.Equal("https://1.1.1.1/video.mkv", link.URL)
+
+	forged := base64TokenPrefix + base64.StdEncoding.EncodeToString([]byte(`{"u":"user","v":"https://1.1.1.1/other.mkv"}`)) + token[strings.LastIndex(token, "."):]
+	_, err = UnwrapProxyLinkToken(forged)
+	s.Error(err)
+}
+
+func (s *Base64ProxyLinkTokenTestSuite) TestPasswordBearing() {
+	defer func(until time.Time) { config.ProxyPasswordTokensUntil = until }(config.ProxyPasswordTokensUntil)
+
+	token := base64TokenPrefix + base64.StdEncoding.EncodeToString([]byte(`{"u":"user:pass","v":"https://1.1.1.1/video.mkv"}`))
+	_, err := UnwrapProxyLinkToken(token)
+	s.NoError(err)
+
+	unknownUser := base64TokenPrefix + base64.StdEncoding.EncodeToString([]byte(`{"u":"nobody","v":"https://1.1.1.1/video.mkv"}`))
+	_, err = UnwrapProxyLinkToken(unknownUser)
+	s.Error(err)
+
+	config.ProxyPasswordTokensUntil = time.Now().Add(-time.Hour)
+	token = base64TokenPrefix + base64.StdEncoding.EncodeToString([]byte(`{"u":"user:pass","v":"https://1.1.1.1/other.mkv"}`))
+	_, err = UnwrapProxyLinkToken(token)
+	s.Error(err)
+}
+
+func (s *Base64ProxyLinkTokenTestSuite) TestExpiredJWT() {
+	token, err := core.GenerateJWT(core.JWTClaims[proxyLinkTokenData]{
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        xid.New().String(),
+			Subject:   "user",
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(-time.Minute)),
+		},
+		Data: &proxyLinkTokenData{EncLink: core.Base64Encode("https://1.1.1.1/video.mkv"), EncFormat: "base64"},
+	})
+	s.Require().NoError(err)
+
+	_, err = UnwrapProxyLinkToken(token)
+	var apiErr *core.APIError
+	s.Require().ErrorAs(err, &apiErr)
+	s.Equal(http.StatusGone, apiErr.StatusCode)
+	s.False(IsInvalidProxyLinkTokenError(err))
+
+	_, cached := invalidProxyLinkTokenCache.Get(token)
+	s.False(cached, "expired tokens are not negative cached")
+}
+
+func TestBase64ProxyLinkToken(t *testing.T) {
+	suite.Run(t, new(Base64ProxyLinkTokenTestSuite))
+}
+
+type UpstreamURLTestSuite struct {
+	suite.Suite
+}
+
+func (s *UpstreamURLTestSuite) TestValidate() {
+	for _, tc := range []struct {
+		url    string
+		status int
+		msg    string
+	}{
+		{"", http.StatusBadRequest, "missing url"},
+		{"https://1.1.1.1/" + strings.Repeat("a", maxUpstreamURLLength), http.StatusBadRequest, "url too long"},
+		{"1.1.1.1/video.mkv", http.StatusBadRequest, "missing scheme"},
+		{"ftp://1.1.1.1/video.mkv", http.StatusBadRequest, "unsupported scheme ftp"},
+		{"file:///etc/passwd", http.StatusBadRequest, "unsupported scheme file"},
+		{"https:///video.mkv", http.StatusBadRequest, "missing host"},
+		{"http://127.0.0.1/video.mkv", http.StatusForbidden, "not allowed"},
+		{"http://[::1]:8080/video.mkv", http.StatusForbidden, "not allowed"},
+		{"HTTPS://1.1.1.1/video.mkv", 0, ""},
+	} {
+		r := httptest.NewRequest("POST", "/v0/proxy", nil)
+		_, err := ValidateUpstreamURL(r, tc.url)
+		if tc.status == 0 {
+			s.NoError(err, tc.url)
+			continue
+		}
+		var apiErr *core.APIError
+		if s.ErrorAs(err, &apiErr, tc.url) {
+			s.Equal(tc.status, apiErr.StatusCode, tc.url)
+			s.Contains(apiErr.Msg, tc.msg, tc.url)
+		}
+	}
+}
+
+func TestUpstreamURL(t *testing.T) {
+	suite.Run(t, new(UpstreamURLTestSuite))
+}
@@ -3,13 +3,20 @@ package shared
 import (
 	"log/slog"
 	"net/http"
+	"net/url"
 	"runtime"
+	"strings"
 	"time"
 
+	"github.com/Dydhzo/stremthru-proxy/internal/config"
 	"github.com/Dydhzo/stremthru-proxy/internal/context"
 	"github.com/Dydhzo/stremthru-proxy/internal/logger"
 	"github.com/Dydhzo/stremthru-proxy/internal/server"
+	"github.com/Dydhzo/stremthru-proxy/internal/tracing"
 	"github.com/rs/xid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type MiddlewareFunc func(http.HandlerFunc) http.HandlerFunc
@@ -27,6 +34,10 @@ func EnableCORS(next http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		if r.Method == http.MethodOptions {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, POST, PUT, PATCH, DELETE")
+			if headers := r.Header.Get("Access-Control-Request-Headers"); headers != "" {
+				w.Header().Set("Access-Control-Allow-Headers", headers)
+			}
 			w.WriteHeader(200)
 			return
 		}
@@ -34,15 +45,44 @@ func EnableCORS(next http.HandlerFunc) http.HandlerFunc {
 	})
 }
 
+// StripPathPrefix serves requests under the path prefix of the public base
+// urls. Unprefixed paths still work, for ingresses that strip it themselves.
+func StripPathPrefix(next http.Handler) http.Handler {
+	prefixes := config.PublicBaseURL.PathPrefixes()
+	if len(prefixes) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, prefix := range prefixes {
+			if r.URL.Path != prefix && !strings.HasPrefix(r.URL.Path, prefix+"/") {
+				continue
+			}
+			r2 := new(http.Request)
+			*r2 = *r
+			r2.URL = new(url.URL)
+			*r2.URL = *r.URL
+			r2.URL.Path = "/" + strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, prefix), "/")
+			r2.URL.RawPath = ""
+			next.ServeHTTP(w, r2)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 var reqLog = logger.Scoped("http")
 
 func RootServerContext(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		rw := &responseWriter{ResponseWriter: w}
-		ctx := &server.ReqCtx{StartTime: time.Now(), ReqPath: r.URL.Path, ReqQuery: r.URL.Query()}
+		ctx := &server.ReqCtx{StartTime: time.Now(), ReqPath: r.URL.Path, ReqQuery: r.URL.Query(), ClientIP: config.TrustedProxy.GetClientIP(r)}
+		r, span := tracing.StartServerSpan(r)
 		r = server.SetReqCtx(r, ctx)
 		r = context.SetProxyContext(r)
 
+		// ended last, after the response is fully sent and logged
+		defer endServerSpan(span, rw, r)
+
 		defer func() {
 			if err := recover(); err != nil {
 				buf := make([]byte, 2048)
@@ -63,6 +103,9 @@ func RootServerContext(next http.Handler) http.Handler {
 		w.Header().Set("Request-ID", ctx.RequestId)
 
 		ctx.Log = slog.With("request_id", ctx.RequestId)
+		if traceID := tracing.TraceID(r.Context()); traceID != "" {
+			ctx.Log = ctx.Log.With("trace_id", traceID)
+		}
 
 		next.ServeHTTP(rw, r)
 		logRequest(rw, r)
@@ -78,24 +121,65 @@ type ResponseWriter interface {
 type responseWriter struct {
 	http.ResponseWriter
 
-	statusCode int
+	statusCode   int
+	bytesWritten int64
+	// when the status line was sent, for the time to first byte
+	firstByteAt time.Time
 }
 
 func (rw *responseWriter) WriteHeader(statusCode int) {
+	if rw.firstByteAt.IsZero() {
+		rw.firstByteAt = time.Now()
+	}
 	rw.statusCode = statusCode
 	rw.ResponseWriter.WriteHeader(statusCode)
 }
 
+func (rw *responseWriter) Write(data []byte) (int, error) {
+	if rw.firstByteAt.IsZero() {
+		rw.firstByteAt = time.Now()
+	}
+	n, err := rw.ResponseWriter.Write(data)
+	rw.bytesWritten += int64(n)
+	return n, err
+}
+
 func (rw *responseWriter) getStatusCode() int {
 	return rw.statusCode
 }
 
+// endServerSpan names the span of r after its path, tokens redacted, and
+// records the response
+func endServerSpan(span trace.Span, w *responseWriter, r *http.Request) {
+	ctx := server.GetReqCtx(r)
+	status := w.getStatusCode()
+	if status == 0 {
+		status = http.StatusOK
+	}
+	span.SetName(r.Method + " " + ctx.ReqPath)
+	span.SetAttributes(
+		attribute.String("url.path", ctx.ReqPath),
+		attribute.String("client.address", ctx.ClientIP),
+		attribute.String("stremthru.request_id", ctx.RequestId),
+		attribute.Int("http.response.status_code", status),
+		attribute.Int64("http.response.body.size", w.bytesWritten),
+	)
+	if ctx.User != "" {
+		span.SetAttributes(attribute.String("enduser.id", ctx.User))
+	}
+	if status >= 500 {
+		span.SetStatus(codes.Error, http.StatusText(status))
+	}
+	span.End()
+}
+
 func logRequest(w *responseWriter, r *http.Request) {
 	ctx := server.GetReqCtx(r)
 
 	status := w.getStatusCode()
 	req := slog.GroupValue(
 		slog.String("id", ctx.RequestId),
+		slog.String("ip", ctx.ClientIP),
 		slog.String("method", r.Method),
 		slog.String("path", ctx.ReqPath),
 		slog.String("query", ctx.ReqQuery.Encode()),
@@ -107,4 +191,5 @@ func logRequest(w *responseWriter, r *http.Request) {
 	} else {
 		reqLog.Error("HTTP Request", "req", req, "status", w.getStatusCode(), "latency", time.Since(ctx.StartTime), "error", ctx.Error)
 	}
+	writeAccessLog(w, r)
 }
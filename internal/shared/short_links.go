@@ -0,0 +1,345 @@
+package shared
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"slices"
+	"time"
+
+	"github.com/Dydhzo/stremthru-proxy/core"
+	"github.com/Dydhzo/stremthru-proxy/internal/config"
+	"github.com/Dydhzo/stremthru-proxy/internal/store"
+)
+
+const (
+	shortLinkBucket       = "proxy_link"
+	shortLinkByUserBucket = "proxy_link_by_user"
+)
+
+// shortLinkRecord is a proxy link stored server side, keyed by its short id
+type shortLinkRecord struct {
+	proxyLinkData
+	CreatedAt    int64 `json:"created_at"`
+	ExpiresAt    int64 `json:"exp,omitempty"`
+	Hits         int64 `json:"hits,omitempty"`
+	LastAccessAt int64 `json:"last_access_at,omitempty"`
+}
+
+func (rec *shortLinkRecord) isExpired(now time.Time) bool {
+	return rec.ExpiresAt != 0 && now.Unix() >= rec.ExpiresAt
+}
+
+func (rec *shortLinkRecord) toProxyLink() *ProxyLink {
+	link := &ProxyLink{
+		ID:              rec.ID,
+		User:            rec.User,
+		URL:             rec.Value,
+		Headers:         rec.Headers,
+		TunnelType:      rec.TunT,
+		ResponseHeaders: rec.RespH,
+		Methods:         rec.Methods,
+		Constraints:     rec.Cons,
+		short:           true,
+	}
+	if rec.ExpiresAt != 0 {
+		link.ExpiresAt = time.Unix(rec.ExpiresAt, 0)
+	}
+	return link
+}
+
+// ShortLink describes a stored short link, for its owner
+type ShortLink struct {
+	*ProxyLink
+	CreatedAt    time.Time
+	Hits         int64
+	LastAccessAt time.Time
+}
+
+func (rec *shortLinkRecord) toShortLink() *ShortLink {
+	sl := &ShortLink{
+		ProxyLink: rec.toProxyLink(),
+		CreatedAt: time.Unix(rec.CreatedAt, 0),
+		Hits:      rec.Hits,
+	}
+	if rec.LastAccessAt != 0 {
+		sl.LastAccessAt = time.Unix(rec.LastAccessAt, 0)
+	}
+	return sl
+}
+
+func storeUserKey(user, id string) string {
+	return user + "\x00" + id
+}
+
+func sweepShortLinks(s *store.Store, now time.Time) (int, error) {
+	expired := []*shortLinkRecord{}
+	err := s.View(func(tx *store.Tx) error {
+		return tx.ForEach(shortLinkBucket, "", func(key string, value []byte) error {
+			rec := &shortLinkRecord{}
+			if err := json.Unmarshal(value, rec); err == nil && rec.isExpired(now) {
+				expired = append(expired, rec)
+			}
+			return nil
+		})
+	})
+	if err != nil || len(expired) == 0 {
+		return 0, err
+	}
+	err = s.Update(func(tx *store.Tx) error {
+		for _, rec := range expired {
+			if err := tx.Delete(shortLinkBucket, rec.ID); err != nil {
+				return err
+			}
+			if err := tx.Delete(shortLinkByUserBucket, storeUserKey(rec.User, rec.ID)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return len(expired), err
+}
+
+// 9 random bytes, 12 url-safe characters. The id alone grants access.
+func newShortLinkID() (string, error) {
+	b := make([]byte, 9)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func errProxyLinkNotFound() error {
+	err := core.NewAPIError("proxy link not found")
+	err.StatusCode = http.StatusNotFound
+	return err
+}
+
+// CreateShortProxyLink stores link server side and returns its short url,
+// filling in the link id and expiry.
+func CreateShortProxyLink(r *http.Request, link *ProxyLink, expiresIn time.Duration, password string, filename string) (string, error) {
+	expiresIn, err := applyLinkExpiryPolicy(r, link.User, expiresIn)
+	if err != nil {
+		return "", err
+	}
+	if err := validateProxyLink(r, link, expiresIn, filename); err != nil {
+		return "", err
+	}
+
+	s, err := getStore()
+	if err != nil {
+		e := ErrorInternalServerError(r, "short links unavailable")
+		e.Cause = err
+		return "", e
+	}
+
+	id, err := newShortLinkID()
+	if err != nil {
+		return "", err
+	}
+	link.ID = id
+	link.Encrypted = false
+
+	now := time.Now()
+	rec := &shortLinkRecord{
+		proxyLinkData: proxyLinkData{
+			ID:      link.ID,
+			User:    link.User,
+			Value:   link.URL,
+			Headers: link.Headers,
+			TunT:    link.TunnelType,
+			RespH:   link.ResponseHeaders,
+			Methods: link.Methods,
+			Cons:    link.Constraints,
+			PwH:     core.TokenPasswordHash(password),
+		},
+		CreatedAt: now.Unix(),
+	}
+	if expiresIn != 0 {
+		link.ExpiresAt = now.Add(expiresIn).Truncate(time.Second)
+		rec.ExpiresAt = link.ExpiresAt.Unix()
+	}
+
+	blob, err := json.Marshal(rec)
+	if err != nil {
+		return "", err
+	}
+	err = s.Update(func(tx *store.Tx) error {
+		if err := tx.Put(shortLinkBucket, rec.ID, blob); err != nil {
+			return err
+		}
+		return tx.Put(shortLinkByUserBucket, storeUserKey(rec.User, rec.ID), nil)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	proxyURL := ExtractRequestBaseURL(r).String() + "/v0/p/" + id
+	if filename != "" {
+		proxyURL += "/" + url.PathEscape(filename)
+	}
+	return proxyURL, nil
+}
+
+// AccessShortProxyLink returns the link stored for id, its hits are counted
+// by RecordShortProxyLinkHit. Links of removed users, or created before a
+// password change, are not found.
+func AccessShortProxyLink(id string) (*ProxyLink, error) {
+	s, err := getStore()
+	if err != nil {
+		return nil, err
+	}
+
+	var link *ProxyLink
+	now := time.Now()
+	err = s.View(func(tx *store.Tx) error {
+		value := tx.Get(shortLinkBucket, id)
+		if value == nil {
+			return errProxyLinkNotFound()
+		}
+		rec := &shortLinkRecord{}
+		if err := json.Unmarshal(value, rec); err != nil {
+			return err
+		}
+		password, hasUser := config.ProxyAuth[rec.User]
+		if !hasUser || !hmac.Equal(rec.PwH, core.TokenPasswordHash(password)) {
+			return errProxyLinkNotFound()
+		}
+		if rec.isExpired(now) {
+			err := core.NewAPIError("proxy link expired")
+			err.StatusCode = http.StatusGone
+			return err
+		}
+		link = rec.toProxyLink()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return link, nil
+}
+
+// RecordShortProxyLinkHit counts a hit of link, when it is a short link,
+// once its response w is sent. Like uses, only requests starting a use that
+// the upstream served count: HEAD requests, seeks and failures do not.
+func RecordShortProxyLinkHit(w http.ResponseWriter, r *http.Request, link *ProxyLink) {
+	if !link.short || r.Method == http.MethodHead || !isProxyLinkUseStart(r) {
+		return
+	}
+	if rw, ok := w.(ResponseWriter); ok && (rw.getStatusCode() < 200 || rw.getStatusCode() >= 300) {
+		return
+	}
+
+	s, err := getStore()
+	if err != nil {
+		proxyLinkLog.Error("failed to record short link access", "id", link.ID, "error", err)
+		return
+	}
+
+	now := time.Now()
+	// concurrent accesses share a write transaction
+	err = s.Batch(func(tx *store.Tx) error {
+		value := tx.Get(shortLinkBucket, link.ID)
+		if value == nil {
+			return nil
+		}
+		rec := &shortLinkRecord{}
+		if err := json.Unmarshal(value, rec); err != nil {
+			return err
+		}
+		rec.Hits++
+		rec.LastAccessAt = now.Unix()
+		blob, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		return tx.Put(shortLinkBucket, link.ID, blob)
+	})
+	if err != nil {
+		proxyLinkLog.Error("failed to record short link access", "id", link.ID, "error", err)
+	}
+}
+
+func getShortLinkRecord(tx *store.Tx, user, id string) (*shortLinkRecord, error) {
+	value := tx.Get(shortLinkBucket, id)
+	if value == nil {
+		return nil, errProxyLinkNotFound()
+	}
+	rec := &shortLinkRecord{}
+	if err := json.Unmarshal(value, rec); err != nil {
+		return nil, err
+	}
+	if rec.User != user {
+		return nil, errProxyLinkNotFound()
+	}
+	return rec, nil
+}
+
+// GetShortProxyLink returns the short link id owned by user
+func GetShortProxyLink(user, id string) (*ShortLink, error) {
+	s, err := getStore()
+	if err != nil {
+		return nil, err
+	}
+	var sl *ShortLink
+	err = s.View(func(tx *store.Tx) error {
+		rec, err := getShortLinkRecord(tx, user, id)
+		if err != nil {
+			return err
+		}
+		sl = rec.toShortLink()
+		return nil
+	})
+	return sl, err
+}
+
+// ListShortProxyLinks returns the short links owned by user, newest first
+func ListShortProxyLinks(user string) ([]*ShortLink, error) {
+	s, err := getStore()
+	if err != nil {
+		return nil, err
+	}
+	links := []*ShortLink{}
+	err = s.View(func(tx *store.Tx) error {
+		return tx.ForEach(shortLinkByUserBucket, storeUserKey(user, ""), func(key string, _ []byte) error {
+			value := tx.Get(shortLinkBucket, key[len(user)+1:])
+			if value == nil {
+				return nil
+			}
+			rec := &shortLinkRecord{}
+			if err := json.Unmarshal(value, rec); err != nil {
+				return err
+			}
+			links = append(links, rec.toShortLink())
+			return nil
+		})
+	})
+	slices.SortStableFunc(links, func(a, b *ShortLink) int {
+		return b.CreatedAt.Compare(a.CreatedAt)
+	})
+	return links, err
+}
+
+// DeleteShortProxyLink removes the short link id owned by user
+func DeleteShortProxyLink(user, id string) error {
+	s, err := getStore()
+	if err != nil {
+		return err
+	}
+	return s.Update(func(tx *store.Tx) error {
+		if _, err := getShortLinkRecord(tx, user, id); err != nil {
+			return err
+		}
+		if err := tx.Delete(shortLinkBucket, id); err != nil {
+			return err
+		}
+		if err := tx.Delete(shortLinkByUserBucket, storeUserKey(user, id)); err != nil {
+			return err
+		}
+		return deleteProxyLinkRecord(tx, user, id)
+	})
+}
@@ -0,0 +1,166 @@
+package shared
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Dydhzo/stremthru-proxy/core"
+	"github.com/Dydhzo/stremthru-proxy/internal/config"
+	"github.com/Dydhzo/stremthru-proxy/internal/server"
+	"github.com/stretchr/testify/suite"
+)
+
+type ShortLinkTestSuite struct {
+	suite.Suite
+}
+
+func (s *ShortLinkTestSuite) SetupSuite() {
+	config.ProxyAuth["short"] = "pass"
+}
+
+func (s *ShortLinkTestSuite) TearDownSuite() {
+	delete(config.ProxyAuth, "short")
+}
+
+func (s *ShortLinkTestSuite) create(expiresIn time.Duration) string {
+	r := httptest.NewRequest("GET", "/v0/proxy", nil)
+	r = server.SetReqCtx(r, &server.ReqCtx{})
+	link := &ProxyLink{User: "short", URL: "https://1.1.1.1/video.mkv", Methods: []string{"post"}}
+	proxyURL, err := CreateShortProxyLink(r, link, expiresIn, "pass", "video.mkv")
+	s.Require().NoError(err)
+	s.True(strings.HasSuffix(proxyURL, "/v0/p/"+link.ID+"/video.mkv"))
+	s.Len(link.ID, 12)
+	return link.ID
+}
+
+func (s *ShortLinkTestSuite) statusCode(err error) int {
+	if e, ok := err.(*core.APIError); ok {
+		return e.StatusCode
+	}
+	return 0
+}
+
+// hit counts a request to link served upstream with status
+func (s *ShortLinkTestSuite) hit(link *ProxyLink, method, rangeHeader string, status int) {
+	r := httptest.NewRequest(method, "/v0/p/"+link.ID, nil)
+	if rangeHeader != "" {
+		r.Header.Set("Range", rangeHeader)
+	}
+	w := &responseWriter{ResponseWriter: httptest.NewRecorder()}
+	w.WriteHeader(status)
+	RecordShortProxyLinkHit(w, r, link)
+}
+
+func (s *ShortLinkTestSuite) hits(id string) int64 {
+	sl, err := GetShortProxyLink("short", id)
+	s.Require().NoError(err)
+	return sl.Hits
+}
+
+func (s *ShortLinkTestSuite) TestLifecycle() {
+	id := s.create(0)
+
+	for range 2 {
+		link, err := AccessShortProxyLink(id)
+		s.Require().NoError(err)
+		s.Equal("https://1.1.1.1/video.mkv", link.URL)
+		s.Equal([]string{"POST"}, link.Methods)
+		s.hit(link, "GET", "", http.StatusOK)
+	}
+	s.Equal(int64(2), s.hits(id))
+
+	_, err := GetShortProxyLink("other", id)
+	s.Equal(http.StatusNotFound, s.statusCode(err))
+
+	links, err := ListShortProxyLinks("short")
+	s.Require().NoError(err)
+	s.Contains(func() []string {
+		ids := []string{}
+		for _, l := range links {
+			ids = append(ids, l.ID)
+		}
+		return ids
+	}(), id)
+
+	s.Equal(http.StatusNotFound, s.statusCode(DeleteShortProxyLink("other", id)))
+	s.NoError(DeleteShortProxyLink("short", id))
+	_, err = AccessShortProxyLink(id)
+	s.Equal(http.StatusNotFound, s.statusCode(err))
+}
+
+func (s *ShortLinkTestSuite) TestHits() {
+	id := s.create(0)
+	link, err := AccessShortProxyLink(id)
+	s.Require().NoError(err)
+	s.Equal(int64(0), s.hits(id), "accesses are counted once served")
+
+	s.hit(link, "GET", "", http.StatusOK)
+	s.hit(link, "GET", "bytes=0-", http.StatusPartialContent)
+	s.hit(link, "HEAD", "", http.StatusOK)
+	s.hit(link, "GET", "bytes=1000-", http.StatusPartialContent)
+	s.hit(link, "GET", "", http.StatusBadGateway)
+	s.hit(link, "GET", "", http.StatusGone)
+	s.Equal(int64(2), s.hits(id))
+
+	s.hit(&ProxyLink{ID: id}, "GET", "", http.StatusOK)
+	s.Equal(int64(2), s.hits(id), "only short links are counted")
+}
+
+func (s *ShortLinkTestSuite) TestPasswordChange() {
+	id := s.create(0)
+
+	config.ProxyAuth["short"] = "changed"
+	defer func() { config.ProxyAuth["short"] = "pass" }()
+
+	_, err := AccessShortProxyLink(id)
+	s.Equal(http.StatusNotFound, s.statusCode(err))
+}
+
+func (s *ShortLinkTestSuite) TestExpiry() {
+	id := s.create(time.Hour)
+
+	_, err := AccessShortProxyLink(id)
+	s.NoError(err)
+
+	st, err := getStore()
+	s.Require().NoError(err)
+
+	count, err := sweepShortLinks(st, time.Now().Add(2*time.Hour))
+	s.Require().NoError(err)
+	s.GreaterOrEqual(count, 1)
+
+	_, err = AccessShortProxyLink(id)
+	s.Equal(http.StatusNotFound, s.statusCode(err))
+	links, err := ListShortProxyLinks("short")
+	s.Require().NoError(err)
+	for _, l := range links {
+		s.NotEqual(id, l.ID)
+	}
+}
+
+func (s *ShortLinkTestSuite) TestConcurrentAccess() {
+	id := s.create(0)
+
+	var wg sync.WaitGroup
+	for range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			link, err := AccessShortProxyLink(id)
+			if s.NoError(err) {
+				s.hit(link, "GET", "", http.StatusOK)
+			}
+		}()
+	}
+	wg.Wait()
+
+	s.Equal(int64(20), s.hits(id))
+}
+
+func TestShortLink(t *testing.T) {
+	suite.Run(t, new(ShortLinkTestSuite))
+}
@@ -0,0 +1,49 @@
+package shared
+
+import (
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/Dydhzo/stremthru-proxy/internal/config"
+	"github.com/Dydhzo/stremthru-proxy/internal/logger"
+	"github.com/Dydhzo/stremthru-proxy/internal/store"
+)
+
+// How often expired entries are removed from the store
+const storeSweepInterval = time.Hour
+
+var storeLog = logger.Scoped("store")
+
+// storeSweepers remove the expired entries of a bucket, returning their count
+var storeSweepers = map[string]func(s *store.Store, now time.Time) (int, error){
+	shortLinkBucket:       sweepShortLinks,
+	proxyLinkRecordBucket: sweepProxyLinkRecords,
+	proxyLinkUsageBucket:  sweepProxyLinkUsages,
+}
+
+func sweepStore(s *store.Store, now time.Time) {
+	for name, sweep := range storeSweepers {
+		if count, err := sweep(s, now); err != nil {
+			storeLog.Error("failed to remove expired entries", "bucket", name, "error", err)
+		} else if count > 0 {
+			storeLog.Info("removed expired entries", "bucket", name, "count", count)
+		}
+	}
+}
+
+// The store is opened on first use, so the data directory is only needed
+// when a feature persisting data is.
+var getStore = sync.OnceValues(func() (*store.Store, error) {
+	s, err := store.Open(filepath.Join(config.DataDir, "stremthru.db"))
+	if err != nil {
+		storeLog.Error("failed to open store", "error", err)
+		return nil, err
+	}
+	go func() {
+		for range time.Tick(storeSweepInterval) {
+			sweepStore(s, time.Now())
+		}
+	}()
+	return s, nil
+})
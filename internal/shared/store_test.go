@@ -0,0 +1,20 @@
+package shared
+
+import (
+	"os"
+	"testing"
+
+	"github.com/Dydhzo/stremthru-proxy/internal/config"
+)
+
+// The store is opened once per process, every suite shares a temporary one.
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "stremthru-test-")
+	if err != nil {
+		panic(err)
+	}
+	config.DataDir = dir
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
@@ -0,0 +1,101 @@
+package store
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Store is a key-value store persisted to a single file on local disk
+type Store struct {
+	db *bolt.DB
+}
+
+// Open opens the store at path, creating it and its directory if needed
+func Open(path string) (*Store, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	return &Store{db: db}, nil
+}
+
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// Tx is a store transaction, buckets are created on first write
+type Tx struct {
+	tx *bolt.Tx
+}
+
+// Get returns the value of key, nil when missing. It is only valid for the
+// life of the transaction.
+func (tx *Tx) Get(bucket, key string) []byte {
+	b := tx.tx.Bucket([]byte(bucket))
+	if b == nil {
+		return nil
+	}
+	return b.Get([]byte(key))
+}
+
+func (tx *Tx) Put(bucket, key string, value []byte) error {
+	b, err := tx.tx.CreateBucketIfNotExists([]byte(bucket))
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(key), value)
+}
+
+func (tx *Tx) Delete(bucket, key string) error {
+	b := tx.tx.Bucket([]byte(bucket))
+	if b == nil {
+		return nil
+	}
+	return b.Delete([]byte(key))
+}
+
+// ForEach calls fn for each key starting with prefix, in key order. The
+// bucket must not be modified from fn.
+func (tx *Tx) ForEach(bucket, prefix string, fn func(key string, value []byte) error) error {
+	b := tx.tx.Bucket([]byte(bucket))
+	if b == nil {
+		return nil
+	}
+	p := []byte(prefix)
+	c := b.Cursor()
+	for k, v := c.Seek(p); k != nil && bytes.HasPrefix(k, p); k, v = c.Next() {
+		if err := fn(string(k), v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// View runs fn in a read-only transaction
+func (s *Store) View(fn func(tx *Tx) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		return fn(&Tx{tx: tx})
+	})
+}
+
+// Update runs fn in a read-write transaction, rolled back if fn fails
+func (s *Store) Update(fn func(tx *Tx) error) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return fn(&Tx{tx: tx})
+	})
+}
+
+// Batch runs fn in a read-write transaction shared with concurrent calls,
+// fn may run more than once and must not have side effects.
+func (s *Store) Batch(fn func(tx *Tx) error) error {
+	return s.db.Batch(func(tx *bolt.Tx) error {
+		return fn(&Tx{tx: tx})
+	})
+}
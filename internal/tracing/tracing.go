@@ -0,0 +1,114 @@
+// Package tracing exports OpenTelemetry spans of the client and upstream
+// legs of proxied requests, and propagates W3C trace context.
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptrace"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/httptrace/otelhttptrace"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/Dydhzo/stremthru-proxy/internal/config"
+)
+
+// Enabled is true when spans are exported
+var Enabled = config.Tracing.Endpoint != ""
+
+// Propagate is true when the traceparent of clients is continued and the
+// trace context is sent upstream. Off by default, so clients can not pick
+// the sampling and trace ids, nor learn them from the upstream requests.
+var Propagate = Enabled && config.Tracing.Propagate
+
+const tracerName = "github.com/Dydhzo/stremthru-proxy"
+
+var propagator = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+
+// Setup registers the OTLP exporter when tracing is enabled. Spans are
+// exported in batches, every few seconds, the returned shutdown flushes
+// those not exported yet.
+func Setup(ctx context.Context) (shutdown func(context.Context) error, err error) {
+	if !Enabled {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(config.Tracing.Endpoint))
+	if err != nil {
+		return nil, err
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		attribute.String("service.name", config.Tracing.ServiceName),
+	))
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.Tracing.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagator)
+	return provider.Shutdown, nil
+}
+
+// Start starts a span, a no-op one when tracing is disabled
+func Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, opts...)
+}
+
+// End records err on span, if any, and ends it
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// StartServerSpan starts the span of the incoming request r, continuing the
+// trace of its traceparent header when propagation is enabled.
+func StartServerSpan(r *http.Request) (*http.Request, trace.Span) {
+	ctx := r.Context()
+	if Propagate {
+		ctx = propagator.Extract(ctx, propagation.HeaderCarrier(r.Header))
+	}
+	ctx, span := otel.Tracer(tracerName).Start(ctx, r.Method, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+		attribute.String("http.request.method", r.Method),
+		attribute.String("network.protocol.version", r.Proto),
+		attribute.String("user_agent.original", r.UserAgent()),
+	))
+	return r.WithContext(ctx), span
+}
+
+// TraceID returns the id of the trace of ctx, empty when not traced
+func TraceID(ctx context.Context) string {
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() && sc.IsSampled() {
+		return sc.TraceID().String()
+	}
+	return ""
+}
+
+// WithClientTrace returns request in ctx, recording its dns, connect, tls and
+// first byte timings as child spans, and propagating the trace upstream when
+// enabled. Request headers are never recorded, they can carry upstream
+// credentials.
+func WithClientTrace(ctx context.Context, request *http.Request) *http.Request {
+	if !Enabled {
+		return request
+	}
+	ctx = httptrace.WithClientTrace(ctx, otelhttptrace.NewClientTrace(ctx, otelhttptrace.WithoutHeaders()))
+	request = request.WithContext(ctx)
+	if Propagate {
+		propagator.Inject(ctx, propagation.HeaderCarrier(request.Header))
+	}
+	return request
+}
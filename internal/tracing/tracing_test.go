@@ -0,0 +1,96 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type TracingTestSuite struct {
+	suite.Suite
+	recorder *tracetest.SpanRecorder
+}
+
+func (s *TracingTestSuite) SetupTest() {
+	Enabled, Propagate = true, true
+	s.recorder = tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(s.recorder)))
+}
+
+func (s *TracingTestSuite) TearDownTest() {
+	Enabled, Propagate = false, false
+	otel.SetTracerProvider(trace.NewNoopTracerProvider())
+}
+
+func (s *TracingTestSuite) TestServerSpan() {
+	traceID := "4bf92f3577b34da6a3ce929d0e0e4736"
+	r := httptest.NewRequest("GET", "/v0/proxy/token", nil)
+	r.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+
+	r, span := StartServerSpan(r)
+	s.Equal(traceID, TraceID(r.Context()), "trace of the client is continued")
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, upstreamReq *http.Request) {
+		s.Contains(upstreamReq.Header.Get("traceparent"), traceID)
+	}))
+	defer upstream.Close()
+
+	ctx, upstreamSpan := Start(r.Context(), "proxy.upstream")
+	request, err := http.NewRequest("GET", upstream.URL, nil)
+	s.Require().NoError(err)
+	response, err := http.DefaultClient.Do(WithClientTrace(context.WithoutCancel(ctx), request))
+	s.Require().NoError(err)
+	response.Body.Close()
+	End(upstreamSpan, nil)
+	span.End()
+
+	names := []string{}
+	for _, ended := range s.recorder.Ended() {
+		names = append(names, ended.Name())
+		s.Equal(traceID, ended.SpanContext().TraceID().String())
+	}
+	s.Contains(names, "http.connect")
+	s.Contains(names, "proxy.upstream")
+	s.Contains(names, "GET")
+}
+
+func (s *TracingTestSuite) TestNotPropagated() {
+	Propagate = false
+	traceID := "4bf92f3577b34da6a3ce929d0e0e4736"
+	r := httptest.NewRequest("GET", "/v0/proxy/token", nil)
+	r.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-00")
+
+	r, span := StartServerSpan(r)
+	defer span.End()
+	s.NotEmpty(TraceID(r.Context()), "traced even though the client asked not to sample")
+	s.NotEqual(traceID, TraceID(r.Context()), "trace of the client is not continued")
+
+	request, err := http.NewRequest("GET", "http://example.com", nil)
+	s.Require().NoError(err)
+	s.Empty(WithClientTrace(r.Context(), request).Header.Get("traceparent"), "trace is not sent upstream")
+}
+
+func (s *TracingTestSuite) TestDisabled() {
+	Enabled, Propagate = false, false
+	shutdown, err := Setup(context.Background())
+	s.Require().NoError(err)
+	s.NoError(shutdown(context.Background()))
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+	request, err := http.NewRequest("GET", "http://example.com", nil)
+	s.Require().NoError(err)
+	s.Empty(WithClientTrace(r.Context(), request).Header.Get("traceparent"), "client trace is not forwarded")
+}
+
+func TestTracing(t *testing.T) {
+	suite.Run(t, new(TracingTestSuite))
+}
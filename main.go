@@ -2,14 +2,24 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/Dydhzo/stremthru-proxy/internal/config"
 	"github.com/Dydhzo/stremthru-proxy/internal/endpoint"
 	"github.com/Dydhzo/stremthru-proxy/internal/shared"
+	"github.com/Dydhzo/stremthru-proxy/internal/tracing"
 )
 
+// How long in-flight requests are given to finish on shutdown
+const shutdownTimeout = 10 * time.Second
+
 func main() {
 	// SECURITY: Proxy authentication is MANDATORY
 	if len(config.ProxyAuth) == 0 {
@@ -20,15 +30,21 @@ func main() {
 
 	config.PrintConfig(&config.AppState{})
 
+	shutdownTracing, err := tracing.Setup(context.Background())
+	if err != nil {
+		log.Fatalf("failed to set up tracing: %v", err)
+	}
+
 	mux := http.NewServeMux()
 
 	// Only keep essential endpoints
 	endpoint.AddRootEndpoint(mux)
 	endpoint.AddHealthEndpoints(mux)
 	endpoint.AddProxyEndpoints(mux)
+	endpoint.AddShortLinkEndpoints(mux)
 	endpoint.AddStatsEndpoint(mux)
 
-	handler := shared.RootServerContext(mux)
+	handler := shared.RootServerContext(shared.StripPathPrefix(mux))
 
 	addr := ":" + config.Port
 	if config.Environment == config.EnvDev {
@@ -38,8 +54,30 @@ func main() {
 
 	// Authentication is guaranteed to exist (checked at startup)
 
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		<-ctx.Done()
+		log.Println("StremThru Proxy shutting down")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Printf("failed to shut down proxy: %v", err)
+		}
+		// streams still open past the timeout must not keep spans from being flushed
+		flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(flushCtx); err != nil {
+			log.Printf("failed to flush traces: %v", err)
+		}
+	}()
+
 	log.Println("StremThru Proxy listening on " + addr)
-	if err := server.ListenAndServe(); err != nil {
+	if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
 		log.Fatalf("failed to start proxy: %v", err)
 	}
+	<-shutdownDone
 }